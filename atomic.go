@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// temporarySuffix marks the temporary files of atomic uploads, which are followed by a random
+// suffix so that concurrent runs do not share them.
+const temporarySuffix = ".scp-tmp-"
+
+// rename moves a remote temporary file to its target path.
+type rename struct {
+	From string
+	To   string
+}
+
+// temporaryName returns a random temporary path in the directory of a remote target.
+func temporaryName(target string) string {
+	random := make([]byte, 6)
+	if _, err := rand.Read(random); err != nil {
+		log.Fatalf("❌ Failed to generate temporary name: %v", err)
+	}
+	return target + temporarySuffix + hex.EncodeToString(random)
+}
+
+// CleanTemporaryFiles removes the temporary files of the given remote targets that were left
+// behind by interrupted atomic uploads, and logs every file that it removes. Only files that
+// were last modified more than maxAge ago are removed, since younger ones may still be written
+// by a concurrent run.
+func CleanTemporaryFiles(client *ssh.Client, targets []string, maxAge time.Duration) error {
+	minutes := int(math.Ceil(maxAge.Minutes()))
+	removed, err := forEachRemote(client, targets, fmt.Sprintf(`for f in "$p"`+temporarySuffix+`*; do if [ -f "$f" ] && [ -n "$(find "$f" -prune -mmin +%d)" ]; then rm -f -- "$f" && printf '%%s\0' "$f"; fi; done`, minutes))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range removed {
+		log.Printf("🧹 Removed leftover temporary file %s", file)
+	}
+	return nil
+}
+
+// RenameRemote moves the temporary files into place, using as few invocations as the command
+// line length allows. Each move replaces its target atomically.
+func RenameRemote(client *ssh.Client, renames []rename) error {
+	var commands []string
+	length := 0
+	for i, r := range renames {
+		command := "mv -f -- " + shellQuote(r.From) + " " + shellQuote(r.To)
+		commands = append(commands, command)
+		length += len(command) + 4
+
+		if i == len(renames)-1 || length+len(renames[i+1].From)+len(renames[i+1].To)+32 > maxCommandLength {
+			if _, err := RunCommand(client, strings.Join(commands, " && ")); err != nil {
+				return fmt.Errorf("failed to move temporary files into place: %v", err)
+			}
+			commands, length = nil, 0
+		}
+	}
+
+	return nil
+}
+
+// removeTemporaryFiles removes the temporary files of renames that are not going to happen,
+// e.g. because the verification failed.
+func removeTemporaryFiles(client *ssh.Client, renames []rename) {
+	temporaries := make([]string, len(renames))
+	for i, r := range renames {
+		temporaries[i] = r.From
+	}
+
+	if err := RunBatched(client, "rm -f --", temporaries); err != nil {
+		log.Printf("⚠️ Failed to remove temporary files: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanTemporaryFilesKeepsRecentFiles(t *testing.T) {
+	client := startTestServer(t)
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "index.html")
+	stale := target + temporarySuffix + "000000000000"
+	recent := target + temporarySuffix + "111111111111"
+	other := filepath.Join(dir, "other.html"+temporarySuffix+"222222222222")
+	for _, name := range []string{target, stale, recent, other} {
+		if err := ioutil.WriteFile(name, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The stale files were left behind by a run that was interrupted an hour ago.
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{stale, other} {
+		if err := os.Chtimes(name, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CleanTemporaryFiles(client, []string{target}, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{target: true, stale: false, recent: true, other: true} {
+		_, err := os.Stat(name)
+		if actual := err == nil; actual != expected {
+			t.Errorf("existence of %s is %v, expected %v", filepath.Base(name), actual, expected)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// getBackupSuffix parses the suffix of the backups of overwritten files, which is empty if no
+// backups are taken.
+func getBackupSuffix() (string, error) {
+	suffix := strings.TrimSpace(os.Getenv("BACKUP_SUFFIX"))
+	if strings.ContainsAny(suffix, `/\`) {
+		return "", errors.New("backup suffix must not contain path separators")
+	}
+	return suffix, nil
+}
+
+// BackupRemote copies the given remote targets that exist to their name with the suffix, keeping
+// their mode and modification time, and returns the backups by target.
+func BackupRemote(client *ssh.Client, targets []string, suffix string) (map[string]string, error) {
+	records, err := forEachRemote(client, targets, `if [ -f "$p" ]; then cp -p -- "$p" "$p"`+shellQuote(suffix)+` && printf '%s\0' "$p"; fi`)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := map[string]string{}
+	for _, target := range records {
+		backups[target] = target + suffix
+	}
+	return backups, nil
+}
+
+// BackupLocal copies the given local targets that exist to their name with the suffix, keeping
+// their mode and modification time, and returns the backups by target.
+func BackupLocal(targets []string, suffix string) (map[string]string, error) {
+	backups := map[string]string{}
+	for _, target := range targets {
+		info, err := os.Stat(target)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		if err := copyLocalFile(target, target+suffix, info); err != nil {
+			return backups, err
+		}
+		backups[target] = target + suffix
+	}
+	return backups, nil
+}
+
+// copyLocalFile copies a local file with its mode and modification time.
+func copyLocalFile(source string, target string, info os.FileInfo) error {
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	copied, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(copied, file); err != nil {
+		copied.Close()
+		return err
+	}
+	if err := copied.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, accessTime(info), info.ModTime())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PassCheck reports the result of a check of the connection and the paths, which fails the
+// action if there is an error.
+func PassCheck(err error) {
+	if err != nil {
+		log.Fatalf("❌ Failed to check paths: %v", err)
+	}
+	log.Printf("✅ Connection check passed, no files were transferred")
+}
+
+// CheckTargets verifies that the targets of the groups can be written on the remote host. A
+// target that does not exist yet is writable if its closest existing parent is a writable
+// directory, since missing directories are created.
+func CheckTargets(client *ssh.Client, groups []sourceGroup) error {
+	var targets []string
+	seen := map[string]bool{}
+	for _, group := range groups {
+		if target := path.Clean(group.Target); !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	unwritable, err := forEachRemote(client, targets, `d="$p"; while [ ! -e "$d" ] && [ ! -L "$d" ]; do d=$(dirname -- "$d"); done; if [ ! -w "$d" ] || { [ "$d" != "$p" ] && [ ! -d "$d" ]; }; then printf '%s\0' "$p"; fi`)
+	if err != nil {
+		return err
+	}
+	if len(unwritable) > 0 {
+		return fmt.Errorf("remote target %s is not writable", strings.Join(unwritable, ", "))
+	}
+
+	for _, target := range targets {
+		log.Printf("✍️ Target %s is writable", target)
+	}
+	return nil
+}
+
+// CheckSources verifies that the sources of the groups exist on the remote host and that their
+// patterns match any files.
+func CheckSources(client *ssh.Client, groups []sourceGroup) error {
+	var sources []string
+	for _, group := range groups {
+		for _, source := range group.Sources {
+			if !strings.ContainsAny(source, remoteGlobMeta) {
+				sources = append(sources, source)
+				continue
+			}
+
+			matches, err := ExpandRemoteGlob(client, source)
+			if err != nil {
+				return fmt.Errorf("failed to expand remote pattern %s: %v", source, err)
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("remote pattern %s does not match any files", source)
+			}
+			log.Printf("🔍 Source %s matches %d paths", source, len(matches))
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+	types, err := probeRemotePaths(client, sources)
+	if err != nil {
+		return err
+	}
+	for i, source := range sources {
+		if types[i] == remoteMissing {
+			return fmt.Errorf("remote source %s does not exist", source)
+		}
+		log.Printf("🔍 Source %s exists", source)
+	}
+
+	return nil
+}
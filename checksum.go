@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SkipIdentical skips all transfers whose target has the same SHA-256 digest as the source.
+// Remote digests are computed in batches. If sha256sum is not available on the remote host,
+// all files are transferred.
+func SkipIdentical(client *ssh.Client, transfers *plan, direction string) error {
+	if _, err := RunCommand(client, "command -v sha256sum"); err != nil {
+		log.Printf("⚠️ Transferring all files, because sha256sum is not available on the remote host")
+		return nil
+	}
+
+	remotePaths := transfers.targetPaths()
+	if direction == DirectionDownload {
+		remotePaths = transfers.sourcePaths()
+	}
+
+	remote, err := RemoteChecksums(client, remotePaths)
+	if err != nil {
+		return err
+	}
+
+	return transfers.skipTransfers(func(t transfer) (string, error) {
+		remotePath, localPath := t.Target, t.Source
+		if direction == DirectionDownload {
+			remotePath, localPath = t.Source, t.Target
+		}
+
+		remoteDigest, ok := remote[remotePath]
+		if !ok {
+			return "", nil
+		}
+
+		localDigest, err := localChecksum(localPath)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		debugf("Comparing %s with digest %s to %s with digest %s", localPath, localDigest, remotePath, remoteDigest)
+		if localDigest != remoteDigest {
+			return "", nil
+		}
+		return skipIdentical, nil
+	})
+}
+
+// VerifyChecksums compares the SHA-256 digests of the sources and targets of the given transfers
+// and returns the digests by source path. Remote digests are computed in batches, and all
+// mismatched files are listed in the returned error.
+func VerifyChecksums(client *ssh.Client, transfers []transfer, direction string) (map[string]string, error) {
+	remotePaths := make([]string, 0, len(transfers))
+	for _, t := range transfers {
+		if direction == DirectionUpload {
+			remotePaths = append(remotePaths, t.Target)
+		} else {
+			remotePaths = append(remotePaths, t.Source)
+		}
+	}
+
+	remote, err := RemoteChecksums(client, remotePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]string{}
+	var mismatches []string
+	for i, t := range transfers {
+		localPath := t.Source
+		if direction == DirectionDownload {
+			localPath = t.Target
+		}
+
+		localDigest, err := localChecksum(localPath)
+		if err != nil {
+			return nil, err
+		}
+
+		remoteDigest, ok := remote[remotePaths[i]]
+		if !ok {
+			remoteDigest = "missing"
+		}
+		if localDigest != remoteDigest {
+			mismatches = append(mismatches, fmt.Sprintf("%s (local %s, remote %s)", t.Target, localDigest, remoteDigest))
+			continue
+		}
+		digests[t.Source] = localDigest
+	}
+
+	if len(mismatches) > 0 {
+		return digests, fmt.Errorf("checksum mismatch for %d files: %s", len(mismatches), strings.Join(mismatches, ", "))
+	}
+
+	return digests, nil
+}
+
+// VerifyExists checks that the targets of uploaded files exist on the remote host. If nonEmpty
+// is set, targets of files that are not empty must not be empty either, which catches writes
+// that the host discarded.
+func VerifyExists(client *ssh.Client, transfers []transfer, nonEmpty bool) error {
+	targets := make([]string, 0, len(transfers))
+	for _, t := range transfers {
+		targets = append(targets, t.Target)
+	}
+
+	remote, err := RemoteStat(client, targets)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, t := range transfers {
+		info, ok := remote[t.Target]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s (missing)", t.Target))
+		} else if nonEmpty && info.Size == 0 && t.Info != nil && t.Info.Size() > 0 {
+			missing = append(missing, fmt.Sprintf("%s (empty)", t.Target))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%d files did not arrive: %s", len(missing), strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// VerifySizes compares the sizes of the sources and targets of the given transfers, which
+// detects truncated files at a lower cost than comparing checksums. Remote sizes are read
+// in batches, and all mismatched files are listed in the returned error.
+func VerifySizes(client *ssh.Client, transfers []transfer, direction string) error {
+	remotePaths := make([]string, 0, len(transfers))
+	for _, t := range transfers {
+		if direction == DirectionUpload {
+			remotePaths = append(remotePaths, t.Target)
+		} else {
+			remotePaths = append(remotePaths, t.Source)
+		}
+	}
+
+	remote, err := RemoteStat(client, remotePaths)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for i, t := range transfers {
+		info, ok := remote[remotePaths[i]]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s (remote file is missing)", t.Target))
+			continue
+		}
+
+		var sourceSize, targetSize int64
+		if direction == DirectionUpload {
+			sourceSize, targetSize = t.Info.Size(), info.Size
+		} else {
+			local, err := os.Stat(t.Target)
+			if err != nil {
+				return err
+			}
+			sourceSize, targetSize = info.Size, local.Size()
+		}
+
+		if sourceSize != targetSize {
+			mismatches = append(mismatches, fmt.Sprintf("%s (source %d bytes, target %d bytes)", t.Target, sourceSize, targetSize))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("size mismatch for %d files: %s", len(mismatches), strings.Join(mismatches, ", "))
+	}
+
+	return nil
+}
+
+// RemoteChecksums computes the SHA-256 digests of the given remote files, omitting missing files.
+func RemoteChecksums(client *ssh.Client, paths []string) (map[string]string, error) {
+	records, err := forEachRemote(client, paths, `if [ -f "$p" ]; then h=$(sha256sum < "$p") && printf '%s %s\0' "${h%% *}" "$p"; fi`)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]string{}
+	for _, record := range records {
+		if len(record) > sha256.Size*2 && record[sha256.Size*2] == ' ' {
+			digests[record[sha256.Size*2+1:]] = record[:sha256.Size*2]
+		}
+	}
+
+	return digests, nil
+}
+
+// localChecksum computes the SHA-256 digest of a local file.
+func localChecksum(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// remotePrefixChecksum computes the SHA-256 digest of the first size bytes of a remote file.
+func remotePrefixChecksum(client *ssh.Client, path string, size int64) (string, error) {
+	output, err := RunCommand(client, fmt.Sprintf("head -c %d -- %s | sha256sum", size, shellQuote(path)))
+	if err != nil {
+		return "", err
+	}
+
+	digest := strings.TrimSpace(output)
+	if i := strings.IndexAny(digest, " \t"); i >= 0 {
+		digest = digest[:i]
+	}
+	if len(digest) != sha256.Size*2 {
+		return "", fmt.Errorf("unexpected output while computing checksum: %q", output)
+	}
+	return digest, nil
+}
+
+// localPrefixChecksum computes the SHA-256 digest of the first size bytes of a local file.
+func localPrefixChecksum(name string, size int64) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, file, size); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// expandCommand replaces the placeholders of a remote command run before or after the
+// transfer. {target} is replaced with the targets of the groups, {files} with the remote paths
+// of the files and {count} with their number. Paths are quoted for the remote shell, so that
+// they are passed as single arguments whatever characters they contain.
+func expandCommand(command string, groups []sourceGroup, transfers []transfer, direction string) string {
+	var targets []string
+	seen := map[string]bool{}
+	for _, group := range groups {
+		if !seen[group.Target] {
+			seen[group.Target] = true
+			targets = append(targets, shellQuote(group.Target))
+		}
+	}
+
+	files := make([]string, len(transfers))
+	for i, t := range transfers {
+		if direction == DirectionUpload {
+			files[i] = shellQuote(t.Target)
+		} else {
+			files[i] = shellQuote(t.Source)
+		}
+	}
+
+	return strings.NewReplacer(
+		"{target}", strings.Join(targets, " "),
+		"{files}", strings.Join(files, " "),
+		"{count}", strconv.Itoa(len(transfers)),
+	).Replace(command)
+}
+
+// RunHook runs a command on the remote host and logs its output.
+func RunHook(client *ssh.Client, name string, command string) error {
+	log.Printf("🪝 Running %s", name)
+	debugf("Running remote command: %s", command)
+
+	output, err := RunCommand(client, command)
+	logOutput(output)
+
+	return err
+}
+
+// expandFileCommand replaces the placeholders of a remote command run after a file was
+// transferred. {target} is replaced with the remote path of the file, which is the target for
+// uploads and the source for downloads, and {source} with the other path, both quoted for the
+// remote shell.
+func expandFileCommand(command string, t transfer, direction string) string {
+	remote, other := t.Target, t.Source
+	if direction != DirectionUpload {
+		remote, other = t.Source, t.Target
+	}
+
+	return strings.NewReplacer("{target}", shellQuote(remote), "{source}", shellQuote(other)).Replace(command)
+}
+
+// RunFileHook runs a command on the remote host after a file was transferred and logs its output.
+func RunFileHook(client *ssh.Client, command string, t transfer, direction string) error {
+	command = expandFileCommand(command, t, direction)
+	debugf("Running remote command: %s", command)
+
+	output, err := RunCommand(client, command)
+	logOutput(output)
+	if err != nil {
+		return fmt.Errorf("per file post command failed: %v", err)
+	}
+
+	return nil
+}
+
+// logOutput logs each line of the output of a remote command.
+func logOutput(output string) {
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if line != "" {
+			log.Printf("    %s", line)
+		}
+	}
+}
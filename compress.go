@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Compression modes of uploaded files.
+const (
+	// CompressNone uploads the files as they are.
+	CompressNone = "none"
+	// CompressStore uploads the files gzipped, adding the .gz extension to their targets.
+	CompressStore = "store"
+	// CompressTransit gzips the files on the wire and decompresses them on the remote host.
+	CompressTransit = "transit"
+)
+
+// compressor uploads gzipped files and records their compressed sizes by source path.
+type compressor struct {
+	mode string
+	// threshold is the largest ratio of compressed to original size for which a file is sent
+	// compressed in transit mode.
+	threshold float64
+	// upload copies a file as it is, e.g. with the remote scp program.
+	upload copyFunc
+
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+// newCompressor parses the compression mode, returning nil if files are not compressed.
+func newCompressor() (*compressor, error) {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("COMPRESS")))
+	switch mode {
+	case "", CompressNone:
+		return nil, nil
+	case CompressStore, CompressTransit:
+	default:
+		return nil, fmt.Errorf("invalid compression mode: %s", mode)
+	}
+
+	threshold := 0.9
+	if value := strings.TrimSpace(os.Getenv("COMPRESS_THRESHOLD")); value != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(value, 64); err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid compression threshold: %s", value)
+		}
+	}
+
+	return &compressor{mode: mode, threshold: threshold, upload: copyTo, sizes: map[string]int64{}}, nil
+}
+
+// copy uploads a local file compressed to a remote path and returns the original size.
+func (c *compressor) copy(client *ssh.Client, local string, remote string) (int64, error) {
+	info, err := os.Stat(local)
+	if err != nil {
+		return 0, err
+	}
+
+	compressed, size, err := gzipFile(local, info)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compress file: %v", err)
+	}
+	defer os.Remove(compressed)
+
+	// Files that barely compress are sent as they are, rather than paying for the
+	// decompression on the remote host.
+	if c.mode == CompressTransit && info.Size() > 0 && float64(size)/float64(info.Size()) > c.threshold {
+		debugf("Sending %s uncompressed, compressed size %s exceeds threshold", local, formatBytes(size))
+		return c.upload(client, local, remote)
+	}
+
+	if c.mode == CompressStore {
+		if _, err := c.upload(client, compressed, remote); err != nil {
+			return 0, err
+		}
+	} else if err := copyGunzip(client, compressed, remote, info); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.sizes[local] = size
+	c.mu.Unlock()
+
+	if !getBool("QUIET") {
+		log.Printf("🗜️ Compressed %s from %s to %s", local, formatBytes(info.Size()), formatBytes(size))
+	}
+
+	return info.Size(), nil
+}
+
+// gzipFile compresses a local file to a temporary file with its mode and modification time,
+// and returns the name and size of the temporary file.
+func gzipFile(name string, info os.FileInfo) (string, int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	temporary, err := ioutil.TempFile("", "scp-action-gzip-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer temporary.Close()
+
+	writer := gzip.NewWriter(temporary)
+	if _, err := io.Copy(writer, file); err != nil {
+		os.Remove(temporary.Name())
+		return "", 0, err
+	}
+	if err := writer.Close(); err != nil {
+		os.Remove(temporary.Name())
+		return "", 0, err
+	}
+
+	compressed, err := temporary.Stat()
+	if err == nil {
+		err = os.Chmod(temporary.Name(), info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(temporary.Name(), accessTime(info), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(temporary.Name())
+		return "", 0, err
+	}
+
+	return temporary.Name(), compressed.Size(), nil
+}
+
+// copyGunzip streams a gzipped local file to the remote gzip program, which decompresses it
+// to the remote path.
+func copyGunzip(client *ssh.Client, compressed string, remote string, info os.FileInfo) error {
+	file, err := os.Open(compressed)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	command := "gzip -d -c > " + shellQuote(remote) + preserveCommand(remote, info)
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stderr := &syncBuffer{}
+	session.Stderr = stderr
+	session.Stdin = limitRate(file)
+	if err := session.Run(command); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%v: %s", err, message)
+		}
+		return err
+	}
+
+	return nil
+}
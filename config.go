@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfig reads settings from a YAML or JSON file, whose keys are the names of the
+// action inputs, and exports them as environment variables. Settings that are already
+// set in the environment take precedence over the file.
+func LoadConfig(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// YAML is a superset of JSON, so both formats are parsed the same way. The settings are
+	// decoded as nodes so that values are exported as written, e.g. a mode of 0644 rather than
+	// the number it denotes.
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+	if len(document.Content) == 0 {
+		return nil
+	}
+	settings := document.Content[0]
+	if settings.Kind != yaml.MappingNode {
+		return fmt.Errorf("invalid config file %s: settings must be a mapping", filename)
+	}
+
+	values := map[string]*yaml.Node{}
+	keys := make([]string, 0, len(settings.Content)/2)
+	for i := 0; i+1 < len(settings.Content); i += 2 {
+		key := settings.Content[i].Value
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = settings.Content[i+1]
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := configValue(values[key])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if os.Getenv(name) != "" {
+			continue
+		}
+
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configValue converts a setting to its environment variable representation, where lists are
+// separated by newlines like multi-line inputs.
+func configValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return configValue(node.Alias)
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		lines := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			line, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, "\n"), nil
+	default:
+		return "", fmt.Errorf("nested settings are not supported")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unsetEnv unsets environment variables for the duration of a test.
+func unsetEnv(t *testing.T, keys ...string) {
+	for _, key := range keys {
+		key := key
+		value, ok := os.LookupEnv(key)
+		os.Unsetenv(key)
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, value)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+func TestLoadConfigReadmeExample(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "scp.yml")
+	example := `host: example.com
+username: deploy
+direction: upload
+source:
+  - dist/
+  - configs/* => /etc/app/
+target: /var/www
+exclude:
+  - "*.map"
+`
+	if err := ioutil.WriteFile(filename, []byte(example), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unsetEnv(t, "HOST", "USERNAME", "DIRECTION", "SOURCE", "TARGET", "EXCLUDE")
+	// Inputs that are not set are passed to the action as empty variables.
+	os.Setenv("USERNAME", "")
+	os.Setenv("TARGET", "")
+
+	if err := LoadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"HOST":      "example.com",
+		"USERNAME":  "deploy",
+		"DIRECTION": "upload",
+		"SOURCE":    "dist/\nconfigs/* => /etc/app/",
+		"TARGET":    "/var/www",
+		"EXCLUDE":   "*.map",
+	}
+	for key, value := range expected {
+		if actual := os.Getenv(key); actual != value {
+			t.Errorf("%s = %q, expected %q", key, actual, value)
+		}
+	}
+}
+
+func TestLoadConfigInputsTakePrecedence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "scp.json")
+	if err := ioutil.WriteFile(filename, []byte(`{"target": "/var/www", "port": 2222}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unsetEnv(t, "TARGET", "PORT")
+	os.Setenv("TARGET", "/srv")
+
+	if err := LoadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if target := os.Getenv("TARGET"); target != "/srv" {
+		t.Errorf("TARGET = %q, expected the input /srv", target)
+	}
+	if port := os.Getenv("PORT"); port != "2222" {
+		t.Errorf("PORT = %q, expected 2222 from the file", port)
+	}
+}
+
+func TestLoadConfigKeepsValuesAsWritten(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "scp.yml")
+	config := `file_mode: 0644
+mode: 0755
+port: 022
+max_rate: 1.50
+quiet: true
+known_hosts: ~
+exclude:
+  - 007
+  - "*.map"
+`
+	if err := ioutil.WriteFile(filename, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unsetEnv(t, "FILE_MODE", "MODE", "PORT", "MAX_RATE", "QUIET", "KNOWN_HOSTS", "EXCLUDE")
+
+	if err := LoadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"FILE_MODE":   "0644",
+		"MODE":        "0755",
+		"PORT":        "022",
+		"MAX_RATE":    "1.50",
+		"QUIET":       "true",
+		"KNOWN_HOSTS": "",
+		"EXCLUDE":     "007\n*.map",
+	}
+	for key, value := range expected {
+		if actual := os.Getenv(key); actual != value {
+			t.Errorf("%s = %q, expected %q", key, actual, value)
+		}
+	}
+}
+
+func TestLoadConfigRejectsNestedSettings(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "scp.yml")
+	if err := ioutil.WriteFile(filename, []byte("proxy:\n  host: bastion\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unsetEnv(t, "PROXY")
+	if err := LoadConfig(filename); err == nil {
+		t.Error("loaded nested settings, expected an error")
+	}
+}
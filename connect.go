@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// connector establishes the connection to the target host, optionally through a proxy host.
+type connector struct {
+	// Name describes the role of the target host in errors.
+	Name          string
+	TargetAddress string
+	TargetConfig  *ssh.ClientConfig
+	TargetKey     string
+	// TargetGSSAPI is set if the target host authenticates with Kerberos.
+	TargetGSSAPI bool
+	// ProxyConfig is nil if no proxy is used.
+	ProxyAddress string
+	ProxyConfig  *ssh.ClientConfig
+	ProxyKey     string
+
+	DialTimeout       time.Duration
+	HandshakeTimeout  time.Duration
+	KeepAliveInterval time.Duration
+	// Retries is the number of times to retry a connection that is refused or dropped by the
+	// host, e.g. because it throttles connections, waiting RetryDelay before the first retry.
+	Retries    int
+	RetryDelay time.Duration
+
+	proxy *ssh.Client
+}
+
+// Dial connects to the target host, replacing any previous connection to the proxy host.
+// The returned error names the host that could not be connected to.
+func (c *connector) Dial() (*ssh.Client, error) {
+	dial := net.Dial
+	if c.ProxyConfig != nil {
+		c.Close()
+
+		// Establish SSH session to proxy host.
+		proxy, err := c.connect("proxy", net.Dial, c.ProxyAddress, c.ProxyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %v", AuthenticationHint(err, c.ProxyConfig.User, c.ProxyKey, false))
+		}
+		c.proxy = proxy
+
+		// Create a TCP connection to from the proxy host to the target.
+		dial = proxy.Dial
+	}
+
+	client, err := c.connect(c.Name, dial, c.TargetAddress, c.TargetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Name, AuthenticationHint(err, c.TargetConfig.User, c.TargetKey, c.TargetGSSAPI))
+	}
+
+	// Prevent the server from dropping the connection while it is idle.
+	if c.KeepAliveInterval > 0 {
+		go KeepAlive(client, c.KeepAliveInterval)
+	}
+
+	return client, nil
+}
+
+// connect connects to a host, retrying with a doubling delay while the host refuses or drops
+// the connection.
+func (c *connector) connect(name string, dial dialFunc, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	delay := c.RetryDelay
+	for attempt := 1; ; attempt++ {
+		client, err := Connect(dial, address, config, c.DialTimeout, c.HandshakeTimeout)
+		if err == nil || attempt > c.Retries || !isThrottled(err) {
+			return client, err
+		}
+
+		log.Printf("🔄 Retrying connection to %s in %v (attempt %d of %d): %v", name, delay, attempt, c.Retries, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isThrottled reports whether a connection error is likely caused by a host that throttles
+// connections, which refuses them or closes them before the handshake completes.
+func isThrottled(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, throttled := range []string{"connection refused", "connection reset", "handshake failed: eof", "closed by remote host", "too many authentication failures"} {
+		if strings.Contains(message, throttled) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close closes the connection to the proxy host, if any.
+func (c *connector) Close() {
+	if c.proxy != nil {
+		c.proxy.Close()
+		c.proxy = nil
+	}
+}
+
+// dialFunc opens a network connection to an address.
+type dialFunc func(network string, address string) (net.Conn, error)
+
+// Connect opens a TCP connection with the dial function and performs the SSH handshake on it.
+// Both phases are bounded by their own timeout, so that network and SSH failures can be told
+// apart. A timeout of zero does not limit the phase.
+func Connect(dial dialFunc, address string, config *ssh.ClientConfig, dialTimeout time.Duration, handshakeTimeout time.Duration) (*ssh.Client, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	dialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := dial("tcp", address)
+		dialed <- dialResult{conn, err}
+	}()
+
+	var conn net.Conn
+	select {
+	case result := <-dialed:
+		if result.err != nil {
+			return nil, result.err
+		}
+		conn = result.conn
+	case <-deadline(dialTimeout):
+		// Close the connection if it is established after all.
+		go func() {
+			if result := <-dialed; result.err == nil {
+				result.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %s timed out after %v", address, dialTimeout)
+	}
+
+	type handshakeResult struct {
+		conn     ssh.Conn
+		channels <-chan ssh.NewChannel
+		requests <-chan *ssh.Request
+		err      error
+	}
+
+	handshaked := make(chan handshakeResult, 1)
+	go func() {
+		c, channels, requests, err := ssh.NewClientConn(conn, address, config)
+		handshaked <- handshakeResult{c, channels, requests, err}
+	}()
+
+	select {
+	case result := <-handshaked:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return ssh.NewClient(result.conn, result.channels, result.requests), nil
+	case <-deadline(handshakeTimeout):
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake with %s timed out after %v", address, handshakeTimeout)
+	}
+}
+
+// deadline returns a channel that fires after the timeout, or never if the timeout is zero.
+func deadline(timeout time.Duration) <-chan time.Time {
+	if timeout <= 0 {
+		return nil
+	}
+	return time.After(timeout)
+}
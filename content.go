@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// checkContent verifies that the given content can be uploaded to the target, which is the
+// exact path of the remote file.
+func checkContent(direction string, target string) error {
+	if direction != DirectionUpload {
+		return errors.New("source content is only supported for uploads")
+	}
+	if target == "" || strings.HasSuffix(target, "/") {
+		return errors.New("source content requires the target to be the path of a file")
+	}
+	return checkRemotePath(target)
+}
+
+// UploadContent writes the content to a remote file with the scp protocol, creating its
+// directory if needed. The file gets the given mode, whether it exists or not. Unless the
+// target may be overwritten, an existing target is left unchanged.
+func UploadContent(client *ssh.Client, target string, content []byte, mode os.FileMode) error {
+	types, err := probeRemotePaths(client, []string{target})
+	if err != nil {
+		return err
+	}
+	switch {
+	case types[0] == remoteDirectory:
+		return fmt.Errorf("remote target %s is a directory", target)
+	case types[0] == remoteFile && !getBoolDefault("OVERWRITE", true):
+		log.Printf("⏭️ Skipping %s: %s", target, skipExists)
+		return nil
+	}
+
+	if getBool("DRY_RUN") {
+		log.Printf("📑 Would write %s to %s", formatBytes(int64(len(content))), target)
+		return nil
+	}
+
+	if types[0] == remoteMissing {
+		if _, err := RunCommand(client, "mkdir -p -- "+shellQuote(path.Dir(target))); err != nil {
+			return fmt.Errorf("failed to create remote directory %s: %v", path.Dir(target), err)
+		}
+	}
+
+	s, err := startSCP(client, "-p -t -- "+shellQuote(target))
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if err := s.readAck(); err != nil {
+		return s.fail(err)
+	}
+	if _, err := fmt.Fprintf(s.stdin, "C%04o %d %s\n", mode, len(content), path.Base(target)); err != nil {
+		return s.fail(err)
+	}
+	if err := s.readAck(); err != nil {
+		return s.fail(err)
+	}
+	if _, err := io.Copy(s.stdin, limitRate(bytes.NewReader(content))); err != nil {
+		return s.fail(err)
+	}
+	if err := s.writeAck(); err != nil {
+		return s.fail(err)
+	}
+	if err := s.readAck(); err != nil {
+		return s.fail(err)
+	}
+
+	log.Printf("📑 Wrote %s to %s", formatBytes(int64(len(content))), target)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CheckFreeSpace verifies that the remote filesystems of the targets have enough free space for
+// the planned files, using df on the closest existing directory of each target directory.
+// Existing files that are replaced are not deducted, so the estimate errs on the safe side.
+func CheckFreeSpace(client *ssh.Client, transfers *plan) error {
+	// Only the top-most target directories are checked, assuming their contents share their filesystem.
+	required := map[string]int64{}
+	for _, t := range regularFiles(transfers.Transfers) {
+		required[path.Dir(t.Target)] += t.Info.Size()
+	}
+	var dirs []string
+	for dir := range required {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var roots []string
+	byRoot := map[string]int64{}
+	for _, dir := range dirs {
+		root := dir
+		for _, r := range roots {
+			if r == "/" || dir == r || strings.HasPrefix(dir, r+"/") {
+				root = r
+				break
+			}
+		}
+		if root == dir {
+			roots = append(roots, dir)
+		}
+		byRoot[root] += required[dir]
+	}
+
+	records, err := forEachRemote(client, roots, `d="$p"; while [ ! -e "$d" ]; do d=$(dirname -- "$d"); done; printf '%s\t' "$p"; df -Pk -- "$d" | awk 'NR == 2 { printf "%s\t%s", $4, $6 }'; printf '\0'`)
+	if err != nil {
+		return fmt.Errorf("failed to check free space: %v", err)
+	}
+
+	// Targets on the same filesystem share its free space.
+	needed := map[string]int64{}
+	available := map[string]int64{}
+	for _, record := range records {
+		fields := strings.SplitN(record, "\t", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("failed to check free space: unexpected output of df: %q", record)
+		}
+		kilobytes, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to check free space: unexpected output of df: %q", record)
+		}
+		needed[fields[2]] += byRoot[fields[0]]
+		available[fields[2]] = kilobytes * 1024
+	}
+
+	var mounts []string
+	for mount := range needed {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+
+	var total int64
+	for _, mount := range mounts {
+		total += needed[mount]
+		debugf("Free space on %s: %s, required: %s", mount, formatBytes(available[mount]), formatBytes(needed[mount]))
+		if needed[mount] > available[mount] {
+			return fmt.Errorf("not enough free space on remote filesystem %s: %s required, %s available", mount, formatBytes(needed[mount]), formatBytes(available[mount]))
+		}
+	}
+
+	log.Printf("💾 Enough free space for %s on the remote host", formatBytes(total))
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Remote path types as reported by the probe script.
+const (
+	remoteDirectory = "d"
+	remoteFile      = "f"
+	remoteMissing   = "m"
+)
+
+// hostPlaceholder is replaced with the sanitized target host in local download targets.
+const hostPlaceholder = "{host}"
+
+// remoteGlobMeta contains the characters that turn a remote source into a glob pattern.
+const remoteGlobMeta = "*?["
+
+// PlanDownload maps the remote source files and directories of a group to local target files.
+// Glob patterns are expanded on the remote host, and directories are listed recursively
+// with their layout being recreated below the target.
+func PlanDownload(client *ssh.Client, transfers *plan, group sourceGroup) error {
+	return planRemote(client, transfers, group, localSide{})
+}
+
+// targetSide abstracts the paths of the host that remote sources are copied to.
+type targetSide interface {
+	// Join joins a target folder with a slash-separated relative path.
+	Join(folder string, relative string) string
+	// IsDir reports whether the target is an existing directory.
+	IsDir(target string) bool
+	// DirMode is the permission mode of created directories, zero leaves the default mode of the host.
+	DirMode() os.FileMode
+}
+
+// localSide describes the local machine as target side of a download.
+type localSide struct{}
+
+func (localSide) Join(folder string, relative string) string {
+	return filepath.Join(folder, filepath.FromSlash(relative))
+}
+
+func (localSide) IsDir(target string) bool {
+	info, err := os.Stat(target)
+	return err == nil && info.IsDir()
+}
+
+func (localSide) DirMode() os.FileMode {
+	return getMode("LOCAL_DIR_MODE", 0755)
+}
+
+// planRemote maps the remote source files and directories of a group to target files on the given side.
+func planRemote(client *ssh.Client, transfers *plan, group sourceGroup, side targetSide) error {
+	sourceFiles := group.Sources
+	targetFileOrFolder := group.Target
+
+	var sources []string
+	globbed := false
+	for _, sourceFile := range sourceFiles {
+		if !strings.ContainsAny(sourceFile, remoteGlobMeta) {
+			sources = append(sources, sourceFile)
+			continue
+		}
+
+		matches, err := ExpandRemoteGlob(client, sourceFile)
+		if err != nil {
+			return fmt.Errorf("failed to expand remote pattern %s: %v", sourceFile, err)
+		}
+
+		if len(matches) == 0 {
+			if err := emptySource("remote pattern %s does not match any files", sourceFile); err != nil {
+				return err
+			}
+		}
+
+		sources = append(sources, matches...)
+		globbed = true
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+
+	types, err := probeRemotePaths(client, sources)
+	if err != nil {
+		return err
+	}
+
+	mode := side.DirMode()
+	maxDepth := 0
+	if value := strings.TrimSpace(os.Getenv("MAX_DEPTH")); value != "" {
+		if maxDepth, err = strconv.Atoi(value); err != nil || maxDepth < 0 {
+			return fmt.Errorf("invalid max depth: %s", value)
+		}
+	}
+
+	for i, sourceFile := range sources {
+		switch types[i] {
+		case remoteMissing:
+			return fmt.Errorf("remote source %s does not exist", sourceFile)
+		case remoteFile:
+			// Rename file if there is only one source file, unless the target is an existing folder.
+			if len(sourceFiles) == 1 && !group.Folder && !globbed && !side.IsDir(targetFileOrFolder) {
+				transfers.addFile(sourceFile, transfer{Source: sourceFile, Target: targetFileOrFolder})
+				continue
+			}
+
+			_, file := path.Split(sourceFile)
+			transfers.addFile(sourceFile, transfer{Source: sourceFile, Target: side.Join(targetFileOrFolder, file)})
+		case remoteDirectory:
+			transfers.addDirectory(".", directory{Path: targetFileOrFolder, Mode: mode})
+
+			directories, err := listRemote(client, sourceFile, "d", maxDepth)
+			if err != nil {
+				return fmt.Errorf("failed to list remote directory %s: %v", sourceFile, err)
+			}
+			for _, dir := range directories {
+				if transfers.hidden(dir) {
+					continue
+				}
+				transfers.addDirectory(dir, directory{Path: side.Join(targetFileOrFolder, dir), Mode: mode})
+			}
+
+			files, err := listRemote(client, sourceFile, "f", maxDepth)
+			if err != nil {
+				return fmt.Errorf("failed to list remote directory %s: %v", sourceFile, err)
+			}
+			files = visibleFiles(transfers, sourceFile, files)
+			for _, file := range files {
+				transfers.addFile(file, transfer{
+					Source: path.Join(sourceFile, file),
+					Target: side.Join(targetFileOrFolder, file),
+				})
+			}
+
+			if len(files) == 0 {
+				if err := emptySource("remote directory %s does not contain any files", sourceFile); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("failed to determine type of remote source %s", sourceFile)
+		}
+	}
+
+	return nil
+}
+
+// visibleFiles removes the hidden files listed in a remote directory.
+func visibleFiles(transfers *plan, directory string, files []string) []string {
+	var visible []string
+	for _, file := range files {
+		if transfers.hidden(file) {
+			debugf("Skipping hidden %s", path.Join(directory, file))
+			continue
+		}
+		visible = append(visible, file)
+	}
+	return visible
+}
+
+// ExpandHostPlaceholder replaces the host placeholder in a local target with the sanitized
+// host name, so that downloads from several hosts do not collide. It reports whether the
+// placeholder is part of the last path segment, which makes the target a per-host folder.
+func ExpandHostPlaceholder(target string, host string) (string, bool) {
+	index := strings.LastIndex(target, hostPlaceholder)
+	if index < 0 {
+		return target, false
+	}
+
+	folder := !strings.ContainsAny(target[index:], `/\`)
+	return strings.ReplaceAll(target, hostPlaceholder, sanitizeHost(host)), folder
+}
+
+// sanitizeHost replaces all characters of a host that are not safe in a file name.
+func sanitizeHost(host string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+// ExpandRemoteGlob expands a glob pattern on the remote host and returns the matching paths.
+func ExpandRemoteGlob(client *ssh.Client, pattern string) ([]string, error) {
+	escaped, err := escapeGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	script := "for f in " + escaped + `; do if [ -e "$f" ] || [ -L "$f" ]; then printf '%s\0' "$f"; fi; done`
+	command := "sh -c " + shellQuote(script)
+	debugf("Expanding remote pattern: %s", command)
+
+	output, err := RunCommand(client, command)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	for _, match := range strings.Split(output, "\x00") {
+		if match != "" {
+			matches = append(matches, match)
+		}
+	}
+
+	return matches, nil
+}
+
+// escapeGlob escapes all characters of a pattern that have a special meaning to the shell,
+// except for the glob characters, so that the pattern is expanded but never evaluated.
+func escapeGlob(pattern string) (string, error) {
+	if strings.ContainsAny(pattern, "\n\r") {
+		return "", fmt.Errorf("pattern must not contain line breaks")
+	}
+
+	var escaped strings.Builder
+	for _, r := range pattern {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("*?[]!^/._-+,:=@%", r) {
+			escaped.WriteRune(r)
+			continue
+		}
+		escaped.WriteRune('\\')
+		escaped.WriteRune(r)
+	}
+
+	return escaped.String(), nil
+}
+
+// probeRemotePaths determines whether each of the given remote paths is a directory, a file or
+// missing, using as few invocations as the command line length allows.
+func probeRemotePaths(client *ssh.Client, paths []string) ([]string, error) {
+	types, err := forEachRemote(client, paths, `if [ -d "$p" ]; then printf '%s\0' `+remoteDirectory+
+		`; elif [ -e "$p" ]; then printf '%s\0' `+remoteFile+
+		`; else printf '%s\0' `+remoteMissing+`; fi`)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(types) != len(paths) {
+		return nil, fmt.Errorf("unexpected output while probing remote sources: %q", types)
+	}
+
+	return types, nil
+}
+
+// listRemote returns the paths of all entries of the given find type below a remote directory,
+// relative to that directory. A maximum depth of zero does not limit the depth.
+func listRemote(client *ssh.Client, directory string, entryType string, maxDepth int) ([]string, error) {
+	expression := "-type " + entryType
+	if maxDepth > 0 {
+		expression = "-maxdepth " + strconv.Itoa(maxDepth) + " " + expression
+	}
+	return findRemote(client, directory, expression)
+}
+
+// findRemote returns the paths of all entries below a remote directory that match the given
+// expression of find, relative to that directory.
+func findRemote(client *ssh.Client, directory string, expression string) ([]string, error) {
+	command := "cd -- " + shellQuote(directory) + " && find . -mindepth 1 " + expression + " -print0"
+
+	output, err := RunCommand(client, command)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	for _, entry := range strings.Split(output, "\x00") {
+		if entry == "" {
+			continue
+		}
+		entries = append(entries, strings.TrimPrefix(entry, "./"))
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// downloadGroup plans and runs the download of a group like Copy does, creating the local
+// directories of the targets first.
+func downloadGroup(t *testing.T, group sourceGroup) (*plan, error) {
+	client := startTestServer(t)
+
+	transfers, err := newPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PlanDownload(client, transfers, group); err != nil {
+		t.Fatal(err)
+	}
+	transfers.addParentDirectories(filepath.Dir, getMode("LOCAL_DIR_MODE", 0755))
+	if err := CreateLocalDirectories(transfers.Directories); err != nil {
+		return transfers, err
+	}
+	for _, transfer := range transfers.Transfers {
+		if _, err := copyFrom(client, transfer.Source, transfer.Target); err != nil {
+			return transfers, err
+		}
+	}
+	return transfers, nil
+}
+
+func TestDownloadIntoNestedMissingTarget(t *testing.T) {
+	unsetEnv(t, "LOCAL_DIR_MODE", "EXCLUDE", "INCLUDE_HIDDEN", "MAX_DEPTH", "PRESERVE_TIMES")
+
+	remote := filepath.Join(t.TempDir(), "logs")
+	for name, content := range map[string]string{"app.log": "app", "archive/2020/old.log": "old"} {
+		name = filepath.Join(remote, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := filepath.Join(t.TempDir(), "artifacts", "remote-logs", "a", "b", "c")
+	// The contents of the remote directory are downloaded into the target.
+	if _, err := downloadGroup(t, sourceGroup{Sources: []string{remote}, Target: target + "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"app.log": "app", "archive/2020/old.log": "old"} {
+		content, err := ioutil.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("%s contains %q, expected %q", name, content, expected)
+		}
+	}
+}
+
+func TestDownloadIntoFileTarget(t *testing.T) {
+	unsetEnv(t, "LOCAL_DIR_MODE", "EXCLUDE", "INCLUDE_HIDDEN", "MAX_DEPTH", "PRESERVE_TIMES")
+
+	remote := filepath.Join(t.TempDir(), "app.log")
+	if err := ioutil.WriteFile(remote, []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "artifacts")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := downloadGroup(t, sourceGroup{Sources: []string{remote}, Target: filepath.Join(file, "logs") + "/"})
+	if err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("downloading below a file returned %v, expected an error that it is not a directory", err)
+	}
+}
+
+func TestProbeRemotePathsInBatches(t *testing.T) {
+	client := startTestServer(t)
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The paths are far longer than a single command line may be.
+	var paths, expected []string
+	missing := filepath.Join(dir, strings.Repeat("m", 200))
+	for i := 0; len(paths)*len(missing) < 4*maxCommandLength; i++ {
+		switch i % 3 {
+		case 0:
+			paths, expected = append(paths, dir), append(expected, remoteDirectory)
+		case 1:
+			paths, expected = append(paths, filepath.Join(dir, "file")), append(expected, remoteFile)
+		default:
+			paths, expected = append(paths, missing), append(expected, remoteMissing)
+		}
+	}
+
+	types, err := probeRemotePaths(client, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(types, "") != strings.Join(expected, "") {
+		t.Errorf("probed %d types %q, expected %d types %q", len(types), strings.Join(types, ""), len(expected), strings.Join(expected, ""))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getBool parses a boolean environment variable. An unset variable is treated as false.
+func getBool(key string) bool {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("❌ Failed to parse %s: %v", strings.ToLower(key), err)
+	}
+
+	return enabled
+}
+
+// getBoolDefault parses a boolean environment variable, returning the fallback if it is unset.
+func getBoolDefault(key string, fallback bool) bool {
+	if strings.TrimSpace(os.Getenv(key)) == "" {
+		return fallback
+	}
+	return getBool(key)
+}
+
+// getList parses a newline-separated list environment variable, ignoring blank lines.
+func getList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), "\n") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// getCommaList parses a list environment variable whose items are separated by commas or
+// newlines, ignoring blank items.
+func getCommaList(key string) []string {
+	var list []string
+	for _, line := range getList(key) {
+		for _, item := range strings.Split(line, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+
+	return list
+}
+
+// getString returns the value of an environment variable, or the fallback if it is unset.
+func getString(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getInt parses an integer environment variable, returning the fallback if it is unset.
+func getInt(key string, fallback int) int {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("❌ Failed to parse %s: %v", strings.ToLower(key), err)
+	}
+
+	return number
+}
+
+// getMode parses an octal permission mode environment variable, returning the fallback if it is unset.
+func getMode(key string, fallback os.FileMode) os.FileMode {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 07777 {
+		log.Fatalf("❌ Failed to parse %s: invalid octal mode: %s", strings.ToLower(key), value)
+	}
+
+	return os.FileMode(mode)
+}
+
+// getDuration parses a duration environment variable, returning the fallback if it is unset.
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("❌ Failed to parse %s: %v", strings.ToLower(key), err)
+	}
+
+	return duration
+}
+
+// debugf logs a message if debug logging is enabled, either explicitly or via the runner.
+func debugf(format string, a ...interface{}) {
+	if getBool("DEBUG") || os.Getenv("RUNNER_DEBUG") == "1" {
+		log.Printf("🐛 "+format, a...)
+	}
+}
@@ -3,7 +3,9 @@ module github.com/nicklasfrahm/scp-action
 go 1.16
 
 require (
-	github.com/dtylman/scp v0.0.0-20181017070807-f3000a34aef4
-	github.com/sirupsen/logrus v1.8.1 // indirect
+	github.com/bmatcuk/doublestar/v4 v4.6.1
+	github.com/jcmturner/gokrb5/v8 v8.4.2
+	github.com/pkg/sftp v1.13.4
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	gopkg.in/yaml.v3 v3.0.1
 )
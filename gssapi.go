@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// AuthMethodDefault authenticates with the given key or password.
+	AuthMethodDefault = "default"
+	// AuthMethodGSSAPI authenticates with Kerberos via GSSAPI.
+	AuthMethodGSSAPI = "gssapi"
+)
+
+// getAuthMethod parses the authentication method of the target and source hosts.
+func getAuthMethod() (string, error) {
+	method := strings.ToLower(strings.TrimSpace(getString("AUTH_METHOD", AuthMethodDefault)))
+	if method != AuthMethodDefault && method != AuthMethodGSSAPI {
+		return "", errors.New("auth method must be either default or gssapi")
+	}
+	return method, nil
+}
+
+// ConfigureGSSAPI configures Kerberos authentication via GSSAPI for a host. The credentials are
+// those of the principal in KERBEROS_PRINCIPAL with the keytab in KERBEROS_KEYTAB or the password,
+// or else those of the ambient ticket cache.
+func ConfigureGSSAPI(host string, password string) []ssh.AuthMethod {
+	krb5conf, err := config.Load(getString("KERBEROS_CONFIG", getString("KRB5_CONFIG", "/etc/krb5.conf")))
+	if err != nil {
+		log.Fatalf("❌ Failed to load kerberos config: %v", err)
+	}
+
+	var cl *client.Client
+	if principal := strings.TrimSpace(os.Getenv("KERBEROS_PRINCIPAL")); principal != "" {
+		username, realm := principal, krb5conf.LibDefaults.DefaultRealm
+		if i := strings.LastIndex(principal, "@"); i >= 0 {
+			username, realm = principal[:i], principal[i+1:]
+		}
+
+		if path := os.Getenv("KERBEROS_KEYTAB"); path != "" {
+			kt, err := keytab.Load(path)
+			if err != nil {
+				log.Fatalf("❌ Failed to load kerberos keytab: %v", err)
+			}
+			cl = client.NewWithKeytab(username, realm, kt, krb5conf, client.DisablePAFXFAST(true))
+		} else if password != "" {
+			cl = client.NewWithPassword(username, realm, password, krb5conf, client.DisablePAFXFAST(true))
+		} else {
+			log.Fatal("❌ Failed to configure authentication method: missing credentials, please provide a keytab or a password for the kerberos principal")
+		}
+	} else {
+		ccache, err := credentials.LoadCCache(ticketCachePath())
+		if err != nil {
+			log.Fatalf("❌ Failed to load kerberos ticket cache: %v", err)
+		}
+		if cl, err = client.NewFromCCache(ccache, krb5conf, client.DisablePAFXFAST(true)); err != nil {
+			log.Fatalf("❌ Failed to load kerberos ticket cache: %v", err)
+		}
+	}
+
+	return []ssh.AuthMethod{ssh.GSSAPIWithMICAuthMethod(&kerberosClient{client: cl}, host)}
+}
+
+// ticketCachePath returns the path of the ambient Kerberos ticket cache, which only supports
+// caches stored in files.
+func ticketCachePath() string {
+	if path := getString("KERBEROS_CCACHE", os.Getenv("KRB5CCNAME")); path != "" {
+		return strings.TrimPrefix(path, "FILE:")
+	}
+	return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+}
+
+// kerberosClient implements the client side of a GSSAPI security context with the Kerberos
+// mechanism, without mutual authentication, so that the context is established by a single token.
+type kerberosClient struct {
+	client *client.Client
+	key    types.EncryptionKey
+	seq    int64
+}
+
+// InitSecContext returns the AP-REQ token for the service ticket of the host, obtaining a ticket
+// granting ticket first if needed.
+func (k *kerberosClient) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	if token != nil {
+		return nil, false, errors.New("unexpected kerberos token from host")
+	}
+
+	// A client from a ticket cache cannot log in, but uses the ticket granting ticket of the cache.
+	if k.client.Credentials.HasKeytab() || k.client.Credentials.HasPassword() {
+		if err := k.client.AffirmLogin(); err != nil {
+			return nil, false, fmt.Errorf("failed to log in to kerberos: %v", err)
+		}
+	}
+
+	// The target is "host@<hostname>", whose service principal is "host/<hostname>".
+	spn := strings.Replace(target, "@", "/", 1)
+	ticket, key, err := k.client.GetServiceTicket(spn)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get kerberos ticket for %s: %v", spn, err)
+	}
+
+	output, err := k.contextToken(ticket, key)
+	return output, false, err
+}
+
+// contextToken returns the initial context token with the AP-REQ for a service ticket and keeps
+// the session key and sequence number of the context.
+func (k *kerberosClient) contextToken(ticket messages.Ticket, key types.EncryptionKey) ([]byte, error) {
+	authenticator, err := types.NewAuthenticator(k.client.Credentials.Domain(), k.client.Credentials.CName())
+	if err != nil {
+		return nil, err
+	}
+	// The checksum carries the context flags, see RFC 4121 section 4.1.1.
+	checksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(checksum[:4], 16)
+	binary.LittleEndian.PutUint32(checksum[20:24], uint32(gssapi.ContextFlagInteg))
+	authenticator.Cksum = types.Checksum{CksumType: chksumtype.GSSAPI, Checksum: checksum}
+
+	request, err := messages.NewAPReq(ticket, key, authenticator)
+	if err != nil {
+		return nil, err
+	}
+	body, err := request.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	k.key, k.seq = key, authenticator.SeqNumber
+
+	// The token wraps the AP-REQ with the mechanism and token ID, see RFC 4121 section 4.1.
+	header, err := asn1.Marshal(asn1.ObjectIdentifier(gssapi.OIDKRB5.OID()))
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, 0x01, 0x00)
+	return asn1tools.AddASNAppTag(append(header, body...), 0), nil
+}
+
+// GetMIC returns a MIC token of the message, signed with the session key of the service ticket.
+func (k *kerberosClient) GetMIC(message []byte) ([]byte, error) {
+	token := gssapi.MICToken{SndSeqNum: uint64(k.seq), Payload: message}
+	if err := token.SetChecksum(k.key, keyusage.GSSAPI_INITIATOR_SIGN); err != nil {
+		return nil, err
+	}
+	return token.Marshal()
+}
+
+// DeleteSecContext forgets the session key of the context.
+func (k *kerberosClient) DeleteSecContext() error {
+	k.key = types.EncryptionKey{}
+	return nil
+}
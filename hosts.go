@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// hostEntry describes a host of a run against several hosts and its overrides of the shared
+// port and username.
+type hostEntry struct {
+	// Name is the host as it was given, which identifies it in logs, outputs and file names.
+	Name     string
+	Host     string
+	Port     string
+	Username string
+}
+
+// parseHost parses a host in the format "[user@]host[:port]". IPv6 addresses with a port must
+// be enclosed in square brackets.
+func parseHost(line string) (hostEntry, error) {
+	entry := hostEntry{Name: line}
+	if index := strings.LastIndex(line, "@"); index >= 0 {
+		entry.Username, line = line[:index], line[index+1:]
+	}
+
+	entry.Host = line
+	if strings.HasPrefix(line, "[") || strings.Count(line, ":") == 1 {
+		host, port, err := net.SplitHostPort(line)
+		if err != nil {
+			return entry, err
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return entry, fmt.Errorf("invalid port in host %q", line)
+		}
+		entry.Host, entry.Port = host, port
+	}
+
+	if entry.Host == "" {
+		return entry, errors.New("host must not be empty")
+	}
+
+	return entry, nil
+}
+
+// RunHosts copies the files to or from each of the given hosts. Every host is handled by a
+// separate run of the action, so that a failing host does not affect the others, and up to
+// HOST_CONCURRENCY hosts are handled at the same time. The counts and byte counts of all hosts are
+// summed up.
+func RunHosts(lines []string) {
+	entries := make([]hostEntry, 0, len(lines))
+	for _, line := range lines {
+		entry, err := parseHost(line)
+		if err != nil {
+			log.Fatalf("❌ Failed to parse target host: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	concurrency := getInt("HOST_CONCURRENCY", 1)
+	if concurrency < 1 {
+		log.Fatalf("❌ Failed to parse host concurrency: %v", errors.New("host concurrency must be at least 1"))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("❌ Failed to run action for hosts: %v", err)
+	}
+
+	continueOnError := getBool("CONTINUE_ON_ERROR")
+	counts := map[string]int{}
+	var failed, failures []string
+	var mu sync.Mutex
+	forEachParallel(len(entries), concurrency, func(i int) bool {
+		outputs, err := runHost(executable, entries[i], &mu)
+		if err == errCancelled {
+			return false
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for name, value := range outputs {
+			if count, err := strconv.Atoi(value); err == nil && (strings.HasSuffix(name, "_count") || strings.HasSuffix(name, "_bytes")) {
+				counts[name] += count
+			}
+		}
+		if err != nil {
+			failed = append(failed, entries[i].Name)
+			failures = append(failures, fmt.Sprintf("%s: %v", entries[i].Name, err))
+			return continueOnError
+		}
+		return true
+	})
+
+	// The runs of the hosts have already reported their progress when they were cancelled.
+	if Cancelling() {
+		os.Exit(exitCancelled)
+	}
+
+	for name, count := range counts {
+		SetOutput(name, fmt.Sprint(count))
+	}
+
+	SetOutput("failed_hosts", strings.Join(failed, "\n"))
+
+	log.Printf("📡 Succeeded on %d of %d hosts", len(entries)-len(failed), len(entries))
+	if len(failed) == 0 {
+		return
+	}
+
+	warn := getBool("FAILURES_AS_WARNINGS")
+	emoji := "❌"
+	if warn {
+		emoji = "⚠️"
+	}
+
+	log.Printf("%s Failed on %d hosts:", emoji, len(failed))
+	for _, failure := range failures {
+		log.Printf("%s %s", emoji, failure)
+	}
+
+	if !warn {
+		os.Exit(1)
+	}
+}
+
+// runHost runs the action for a single host and returns its outputs. Every line that the run
+// logs is prefixed with the host.
+func runHost(executable string, entry hostEntry, mu *sync.Mutex) (map[string]string, error) {
+	output, err := ioutil.TempFile("", "scp-action-output-")
+	if err != nil {
+		return nil, err
+	}
+	output.Close()
+	defer os.Remove(output.Name())
+
+	env := map[string]string{
+		"HOST":          entry.Host,
+		"TARGET_HOST":   "",
+		"GITHUB_OUTPUT": output.Name(),
+	}
+	if entry.Port != "" {
+		env["PORT"] = entry.Port
+	}
+	if entry.Username != "" {
+		env["USERNAME"] = entry.Username
+	}
+	for _, key := range []string{"SUMMARY_FILE", "METRICS_FILE"} {
+		if filename := os.Getenv(key); filename != "" {
+			env[key] = hostFilename(filename, entry.Name)
+		}
+	}
+
+	logs := &prefixWriter{prefix: "[" + entry.Name + "] ", mu: mu}
+	cmd := exec.Command(executable)
+	cmd.Env = withEnv(os.Environ(), env)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if err = cmd.Start(); err == nil {
+		// Let the run of the host report its progress if the action is cancelled.
+		done := make(chan struct{})
+		OnCancel(func() {
+			cmd.Process.Signal(syscall.SIGTERM)
+			<-done
+		})
+		err = cmd.Wait()
+		close(done)
+	}
+	logs.Flush()
+
+	// The cancelled run is not reported as a failure.
+	if Cancelling() {
+		return nil, errCancelled
+	}
+
+	outputs, readErr := readOutputs(output.Name())
+	if err == nil {
+		err = readErr
+	}
+
+	return outputs, err
+}
+
+// hostFilename returns the file name for a host, either by replacing the host placeholder or
+// by adding the sanitized host before the extension.
+func hostFilename(filename string, host string) string {
+	if expanded, _ := ExpandHostPlaceholder(filename, host); expanded != filename {
+		return expanded
+	}
+
+	extension := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, extension) + "-" + sanitizeHost(host) + extension
+}
+
+// withEnv returns the environment with the given variables set.
+func withEnv(environ []string, values map[string]string) []string {
+	env := make([]string, 0, len(environ)+len(values))
+	for _, variable := range environ {
+		if _, ok := values[strings.SplitN(variable, "=", 2)[0]]; !ok {
+			env = append(env, variable)
+		}
+	}
+	for key, value := range values {
+		env = append(env, key+"="+value)
+	}
+
+	return env
+}
+
+// prefixWriter writes complete lines to the standard error with a prefix, so that the lines
+// of concurrent runs do not interleave.
+type prefixWriter struct {
+	prefix string
+	mu     *sync.Mutex
+	buffer []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	if index := bytes.LastIndexByte(w.buffer, '\n'); index >= 0 {
+		w.write(w.buffer[:index+1])
+		w.buffer = w.buffer[index+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the remainder of an incomplete last line.
+func (w *prefixWriter) Flush() {
+	if len(w.buffer) > 0 {
+		w.write(append(w.buffer, '\n'))
+		w.buffer = nil
+	}
+}
+
+func (w *prefixWriter) write(lines []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	scanner := bufio.NewScanner(bytes.NewReader(lines))
+	for scanner.Scan() {
+		fmt.Fprintln(os.Stderr, w.prefix+scanner.Text())
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"path"
 	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
-
-	"github.com/dtylman/scp"
 )
 
 const (
@@ -21,98 +21,306 @@ const (
 	DirectionDownload = "download"
 )
 
-type copyFunc func(client *ssh.Client, source string, target string) (int64, error)
+const (
+	// defaultTimeout bounds the connection to a host unless TIMEOUT is set.
+	defaultTimeout = 30 * time.Second
+	// defaultActionTimeout bounds the whole run unless ACTION_TIMEOUT is set.
+	defaultActionTimeout = 10 * time.Minute
+)
 
 func main() {
+	// Load settings that are not set as inputs from the config file.
+	if filename := os.Getenv("CONFIG_FILE"); filename != "" {
+		if err := LoadConfig(filename); err != nil {
+			log.Fatalf("❌ Failed to load config file: %v", err)
+		}
+	}
+
+	// Parse the modes and owners of uploaded files before connecting, since they are applied last.
+	if _, err := getFileModes(); err != nil {
+		log.Fatalf("❌ Failed to parse mode: %v", err)
+	}
+	if _, err := getFileOwners(); err != nil {
+		log.Fatalf("❌ Failed to parse owner: %v", err)
+	}
+
 	// Parse timeout.
-	actionTimeout, err := time.ParseDuration(os.Getenv("ACTION_TIMEOUT"))
-	if err != nil {
-		log.Fatalf("❌ Failed to parse action timeout: %v", err)
+	actionTimeout := getDuration("ACTION_TIMEOUT", defaultActionTimeout)
+
+	// Stop the action if it takes longer that the specified timeout, unless it is zero.
+	if actionTimeout > 0 {
+		actionTimeoutTimer := time.NewTimer(actionTimeout)
+		go func() {
+			<-actionTimeoutTimer.C
+			log.Fatalf("❌ Failed to run action: %v", errors.New("action timed out"))
+			os.Exit(1)
+		}()
 	}
 
-	// Stop the action if it takes longer that the specified timeout.
-	actionTimeoutTimer := time.NewTimer(actionTimeout)
-	go func() {
-		<-actionTimeoutTimer.C
-		log.Fatalf("❌ Failed to run action: %v", errors.New("action timed out"))
-		os.Exit(1)
-	}()
+	// Exit cleanly if the job is cancelled.
+	HandleSignals()
+
+	// The target host of a copy between two remote hosts may also be given as TARGET_HOST.
+	if host := os.Getenv("TARGET_HOST"); host != "" {
+		os.Setenv("HOST", host)
+	}
+	sourceHost := os.Getenv("SOURCE_HOST")
 
-	// Parse direction.
+	// Parse direction, which is implied when copying between two remote hosts.
 	direction := os.Getenv("DIRECTION")
-	if direction != DirectionDownload && direction != DirectionUpload {
+	if sourceHost == "" && direction != DirectionDownload && direction != DirectionUpload {
 		log.Fatalf("❌ Failed to parse direction: %v", errors.New("direction must be either upload or download"))
 	}
 
-	// Parse timeout.
-	timeout, err := time.ParseDuration(os.Getenv("TIMEOUT"))
+	// Parse sources before connecting, so that there is nothing to do if none are specified.
+	var groups []sourceGroup
+	var err error
+	sources := SplitSources(os.Getenv("SOURCE"), os.Getenv("SOURCE_DELIMITER"))
+	if filename := os.Getenv("MANIFEST"); filename != "" {
+		lines, err := ReadManifest(filename)
+		if err != nil {
+			log.Fatalf("❌ Failed to read manifest: %v", err)
+		}
+		sources = append(sources, lines...)
+	}
+	if targets := getList("TARGET"); len(targets) > 1 {
+		groups, err = PairSources(sources, targets)
+	} else {
+		groups, err = ParseSources(sources, strings.TrimSpace(getString("TARGET", ".")), os.Getenv("MAPPING_SEPARATOR"))
+	}
 	if err != nil {
-		log.Fatalf("❌ Failed to parse timeout: %v", err)
+		log.Fatalf("❌ Failed to parse source: %v", err)
+	}
+	// Upload the given content to the target instead of source files.
+	content := os.Getenv("SOURCE_CONTENT")
+	contentMode := getMode("FILE_MODE", scpFileMode)
+	if content != "" {
+		target := strings.TrimSpace(getString("TARGET", "."))
+		err := checkContent(direction, target)
+		if err == nil && (len(groups) > 0 || sourceHost != "") {
+			err = errors.New("source content cannot be combined with source files or a source host")
+		}
+		if err != nil {
+			log.Fatalf("❌ Failed to parse source content: %v", err)
+		}
+		groups = []sourceGroup{{Target: target}}
+	}
+
+	// A check without sources only verifies the connection.
+	checkOnly := getBool("CHECK_ONLY")
+	if len(groups) == 0 && !checkOnly {
+		if getBool("STRICT") {
+			log.Fatalf("❌ Failed to parse source: %v", errors.New("no source files specified"))
+		}
+		log.Printf("⚠️ No source files specified")
+		os.Exit(0)
+	}
+
+	// Resolve relative local paths in the working directory.
+	if dir := os.Getenv("WORKING_DIR"); dir != "" && sourceHost == "" {
+		if err := ResolveWorkingDir(groups, dir, direction); err != nil {
+			log.Fatalf("❌ Failed to parse working directory: %v", err)
+		}
 	}
 
+	// Parse timeout.
+	timeout := getDuration("TIMEOUT", defaultTimeout)
+
 	// Parse target host.
 	targetHost := os.Getenv("HOST")
 	if targetHost == "" {
 		log.Fatalf("❌ Failed to parse target host: %v", errors.New("target host must not be empty"))
 	}
 
+	// Run the action for each host separately if several are given.
+	if hosts := getList("HOST"); len(hosts) > 1 {
+		RunHosts(hosts)
+		return
+	}
+
+	// Parse client version, which replaces the default of crypto/ssh if set.
+	clientVersion := os.Getenv("CLIENT_VERSION")
+	if clientVersion != "" && !strings.HasPrefix(clientVersion, "SSH-2.0-") {
+		log.Fatalf("❌ Failed to parse client version: %v", errors.New("client version must start with SSH-2.0-"))
+	}
+
+	sshOptions, err := getSSHOptions()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse extra ssh options: %v", err)
+	}
+
+	// Authenticate with Kerberos instead of a key or password if requested.
+	authMethod, err := getAuthMethod()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse auth method: %v", err)
+	}
+	var targetAuth []ssh.AuthMethod
+	if authMethod == AuthMethodGSSAPI {
+		targetAuth = ConfigureGSSAPI(targetHost, os.Getenv("INSECURE_PASSWORD"))
+	} else {
+		targetAuth = ConfigureAuthentication(os.Getenv("KEY"), os.Getenv("INSECURE_PASSWORD"))
+	}
+
 	// Create configuration for SSH target.
 	targetConfig := &ssh.ClientConfig{
-		Timeout:         timeout,
-		User:            os.Getenv("USERNAME"),
-		Auth:            ConfigureAuthentication(os.Getenv("KEY"), os.Getenv("INSECURE_PASSWORD")),
-		HostKeyCallback: VerifyFingerprint(os.Getenv("FINGERPRINT")),
+		Timeout:           timeout,
+		User:              getString("USERNAME", "root"),
+		Auth:              targetAuth,
+		HostKeyCallback:   VerifyFingerprint(os.Getenv("FINGERPRINT"), os.Getenv("EXPECTED_HOST_KEY_TYPE"), os.Getenv("HOST_PUBLIC_KEY")),
+		HostKeyAlgorithms: getCommaList("HOST_KEY_ALGORITHMS"),
+		ClientVersion:     clientVersion,
+		BannerCallback:    LogBanner(os.Getenv("BANNER_FILE")),
 	}
 
-	// Configure target address.
-	targetAddress := os.Getenv("HOST") + ":" + os.Getenv("PORT")
-
-	// Initialize target SSH client.
-	var targetClient *ssh.Client
+	// Configure the connection to the target, bounding the phases separately and falling back
+	// to the overall timeout.
+	target := &connector{
+		Name:              "target",
+		TargetAddress:     targetHost + ":" + getString("PORT", "22"),
+		TargetConfig:      targetConfig,
+		TargetKey:         os.Getenv("KEY"),
+		TargetGSSAPI:      authMethod == AuthMethodGSSAPI,
+		DialTimeout:       getDuration("DIAL_TIMEOUT", timeout),
+		HandshakeTimeout:  getDuration("HANDSHAKE_TIMEOUT", timeout),
+		KeepAliveInterval: getDuration("KEEPALIVE_INTERVAL", 0),
+		Retries:           getInt("CONNECT_RETRIES", 0),
+		RetryDelay:        getDuration("CONNECT_RETRY_DELAY", time.Second),
+	}
+	applySSHOptions(sshOptions, targetConfig, target)
 
 	// Check if a proxy should be used.
 	if proxyHost := os.Getenv("PROXY_HOST"); proxyHost != "" {
 		// Create SSH config for SSH proxy.
-		proxyConfig := &ssh.ClientConfig{
-			Timeout:         timeout,
-			User:            os.Getenv("PROXY_USERNAME"),
-			Auth:            ConfigureAuthentication(os.Getenv("PROXY_KEY"), os.Getenv("INSECURE_PROXY_PASSWORD")),
-			HostKeyCallback: VerifyFingerprint(os.Getenv("PROXY_FINGERPRINT")),
+		target.ProxyConfig = &ssh.ClientConfig{
+			Timeout:           timeout,
+			User:              getString("PROXY_USERNAME", "root"),
+			Auth:              ConfigureAuthentication(os.Getenv("PROXY_KEY"), os.Getenv("INSECURE_PROXY_PASSWORD")),
+			HostKeyCallback:   VerifyFingerprint(os.Getenv("PROXY_FINGERPRINT"), os.Getenv("PROXY_EXPECTED_HOST_KEY_TYPE"), os.Getenv("PROXY_HOST_PUBLIC_KEY")),
+			HostKeyAlgorithms: getCommaList("PROXY_HOST_KEY_ALGORITHMS"),
+			ClientVersion:     clientVersion,
 		}
+		target.ProxyAddress = proxyHost + ":" + getString("PROXY_PORT", "22")
+		target.ProxyKey = os.Getenv("PROXY_KEY")
+	}
+	defer target.Close()
+	OnCancel(target.Close)
 
-		// Establish SSH session to proxy host.
-		proxyAddress := proxyHost + ":" + os.Getenv("PROXY_PORT")
-		proxyClient, err := ssh.Dial("tcp", proxyAddress, proxyConfig)
-		if err != nil {
-			log.Fatalf("❌ Failed to connect to proxy: %v", err)
+	targetClient, err := target.Dial()
+	if err != nil {
+		log.Fatalf("❌ Failed to connect to %v", err)
+	}
+	defer func() {
+		if targetClient != nil {
+			targetClient.Close()
 		}
-		defer proxyClient.Close()
+	}()
 
-		// Create a TCP connection to from the proxy host to the target.
-		netConn, err := proxyClient.Dial("tcp", targetAddress)
-		if err != nil {
-			log.Fatalf("❌ Failed to dial to target: %v", err)
+	// Copy between two remote hosts if a source host is given, using the settings of the target
+	// host unless they are overridden.
+	if sourceHost != "" {
+		// Kerberos also applies to the source host, unless it has a key of its own.
+		var sourceAuth []ssh.AuthMethod
+		if authMethod == AuthMethodGSSAPI && os.Getenv("SOURCE_KEY") == "" {
+			sourceAuth = ConfigureGSSAPI(sourceHost, getString("INSECURE_SOURCE_PASSWORD", os.Getenv("INSECURE_PASSWORD")))
+		} else {
+			sourceAuth = ConfigureAuthentication(getString("SOURCE_KEY", os.Getenv("KEY")), getString("INSECURE_SOURCE_PASSWORD", os.Getenv("INSECURE_PASSWORD")))
 		}
+		source := &connector{
+			Name:          "source",
+			TargetAddress: sourceHost + ":" + getString("SOURCE_PORT", getString("PORT", "22")),
+			TargetConfig: &ssh.ClientConfig{
+				Timeout:           timeout,
+				User:              getString("SOURCE_USERNAME", targetConfig.User),
+				Auth:              sourceAuth,
+				HostKeyCallback:   VerifyFingerprint(os.Getenv("SOURCE_FINGERPRINT"), os.Getenv("SOURCE_EXPECTED_HOST_KEY_TYPE"), os.Getenv("SOURCE_HOST_PUBLIC_KEY")),
+				HostKeyAlgorithms: getCommaList("SOURCE_HOST_KEY_ALGORITHMS"),
+				ClientVersion:     clientVersion,
+			},
+			TargetKey:         getString("SOURCE_KEY", os.Getenv("KEY")),
+			TargetGSSAPI:      authMethod == AuthMethodGSSAPI && os.Getenv("SOURCE_KEY") == "",
+			DialTimeout:       target.DialTimeout,
+			HandshakeTimeout:  target.HandshakeTimeout,
+			KeepAliveInterval: target.KeepAliveInterval,
+			Retries:           target.Retries,
+			RetryDelay:        target.RetryDelay,
+		}
+		applySSHOptions(sshOptions, source.TargetConfig, source)
 
-		targetConn, channel, req, err := ssh.NewClientConn(netConn, targetAddress, targetConfig)
+		sourceClient, err := source.Dial()
 		if err != nil {
-			log.Fatalf("❌ Failed to connect to target: %v", err)
+			log.Fatalf("❌ Failed to connect to %v", err)
 		}
+		defer sourceClient.Close()
 
-		targetClient = ssh.NewClient(targetConn, channel, req)
-	} else {
-		if targetClient, err = ssh.Dial("tcp", targetAddress, targetConfig); err != nil {
-			log.Fatalf("❌ Failed to connect to target: %v", err)
+		if checkOnly {
+			err = CheckSources(sourceClient, groups)
+			if err == nil {
+				err = CheckTargets(targetClient, groups)
+			}
+			PassCheck(err)
+			return
+		}
+
+		Relay(sourceClient, targetClient, groups)
+		return
+	}
+
+	if content != "" && !checkOnly {
+		if err := UploadContent(targetClient, groups[0].Target, []byte(content), contentMode); err != nil {
+			log.Fatalf("❌ Failed to upload content: %v", err)
+		}
+		return
+	}
+
+	if checkOnly {
+		if direction == DirectionUpload {
+			err = CheckTargets(targetClient, groups)
+		} else {
+			err = CheckSources(targetClient, groups)
+		}
+		PassCheck(err)
+		return
+	}
+
+	// Replace the client if the connection is lost during the transfer.
+	reconnect := func() (*ssh.Client, error) {
+		if targetClient != nil {
+			targetClient.Close()
 		}
+		targetClient, err = target.Dial()
+		return targetClient, err
 	}
-	defer targetClient.Close()
 
-	Copy(targetClient)
+	Copy(targetClient, reconnect, groups)
 }
 
 // VerifyFingerprint takes an ssh key fingerprint as an argument and verifies it against and SSH public key.
-func VerifyFingerprint(expected string) ssh.HostKeyCallback {
+// If a key type is given, the public key must also be of that type. If a pinned public key in
+// authorized_keys format is given, the public key must match it exactly and the fingerprint
+// may be omitted.
+func VerifyFingerprint(expected string, keyType string, pinnedKey string) ssh.HostKeyCallback {
+	var pinned ssh.PublicKey
+	if pinnedKey = strings.TrimSpace(pinnedKey); pinnedKey != "" {
+		var err error
+		if pinned, _, _, _, err = ssh.ParseAuthorizedKey([]byte(pinnedKey)); err != nil {
+			log.Fatalf("❌ Failed to parse host public key: %v", err)
+		}
+	}
+
 	return func(hostname string, remote net.Addr, pubKey ssh.PublicKey) error {
+		if keyType != "" && pubKey.Type() != keyType {
+			return errors.New("host key type mismatch: server key type: " + pubKey.Type())
+		}
+
+		if pinned != nil {
+			if !bytes.Equal(pinned.Marshal(), pubKey.Marshal()) {
+				return errors.New("host public key mismatch: server fingerprint: " + ssh.FingerprintSHA256(pubKey))
+			}
+			if expected == "" {
+				return nil
+			}
+		}
+
 		fingerprint := ssh.FingerprintSHA256(pubKey)
 		if fingerprint != expected {
 			return errors.New("fingerprint mismatch: server fingerprint: " + fingerprint)
@@ -122,59 +330,36 @@ func VerifyFingerprint(expected string) ssh.HostKeyCallback {
 	}
 }
 
-// Copy transfers files between remote host and local machine.
-func Copy(client *ssh.Client) {
-	sourceFiles := strings.Split(os.Getenv("SOURCE"), "\n")
-	targetFileOrFolder := strings.TrimSpace(os.Getenv("TARGET"))
-	direction := os.Getenv("DIRECTION")
-
-	var copy copyFunc
-	var emoji string
-	if direction == DirectionDownload {
-		copy = scp.CopyFrom
-		emoji = "🔽"
-	}
-	if direction == DirectionUpload {
-		copy = scp.CopyTo
-		emoji = "🔼"
-	}
-
-	log.Printf("%s %sing ...\n", emoji, strings.Title(direction))
-	if len(sourceFiles) == 1 {
-		// Rename file if there is only one source file.
-		if _, err := copy(client, sourceFiles[0], targetFileOrFolder); err != nil {
-			log.Fatalf("❌ Failed to %s file from remote: %v", os.Getenv("DIRECTION"), err)
+// LogBanner logs the login banner of the server and, if a filename is given, writes it to that file.
+func LogBanner(filename string) ssh.BannerCallback {
+	return func(message string) error {
+		for _, line := range strings.Split(strings.TrimRight(message, "\r\n"), "\n") {
+			log.Println("📜 " + strings.TrimRight(line, "\r"))
 		}
-		log.Println("📑 " + sourceFiles[0] + " >> " + targetFileOrFolder)
 
-		log.Println("📡 Transferred 1 file")
-	} else {
-		transferredFiles := int64(0)
-
-		for _, sourceFile := range sourceFiles {
-			_, file := path.Split(sourceFile)
-			targetFile := path.Join(targetFileOrFolder, file)
-
-			if _, err := copy(client, sourceFile, targetFile); err != nil {
-				log.Fatalf("❌ Failed to %s file from remote: %v", os.Getenv("DIRECTION"), err)
+		if filename != "" {
+			if err := ioutil.WriteFile(filename, []byte(message), 0644); err != nil {
+				return fmt.Errorf("failed to write banner file: %v", err)
 			}
-			log.Println("📑 " + sourceFile + " >> " + targetFile)
-
-			transferredFiles += 1
 		}
 
-		log.Printf("📡 Transferred %d files\n", transferredFiles)
+		return nil
 	}
 }
 
 // ConfigureAuthentication configures the authentication method.
 func ConfigureAuthentication(key string, password string) []ssh.AuthMethod {
+	attempts := getInt("AUTH_ATTEMPTS", 1)
+	if attempts < 1 {
+		log.Fatalf("❌ Failed to parse auth attempts: %v", errors.New("auth attempts must be at least 1"))
+	}
+
 	// Create signer for public key authentication method.
 	auth := make([]ssh.AuthMethod, 1)
-	if key != "" {
+	if key = normalizeKey(key); key != "" {
 		targetSigner, err := ssh.ParsePrivateKey([]byte(key))
 		if err != nil {
-			log.Fatalf("❌ Failed to parse private key: %v", err)
+			log.Fatalf("❌ Failed to parse private key: %v, please check that the whole key including the BEGIN and END lines was pasted into the secret, without indentation or escaped newlines", err)
 		}
 
 		// Configure public key authentication.
@@ -185,8 +370,40 @@ func ConfigureAuthentication(key string, password string) []ssh.AuthMethod {
 		log.Println("⚠️ Using a password for authentication is insecure!")
 		log.Println("⚠️ Please consider using public key authentication!")
 	} else {
-		log.Fatal("❌ Failed to configure authentication method: missing credentials")
+		log.Fatal("❌ Failed to configure authentication method: missing credentials, please provide a key or a password")
+	}
+
+	// Retry the authentication method, e.g. for servers that ask for the password again.
+	if attempts > 1 {
+		auth[0] = ssh.RetryableAuthMethod(auth[0], attempts)
 	}
 
 	return auth
 }
+
+// normalizeKey removes whitespace around a private key and converts CRLF line endings, which
+// keys often gain when they are pasted into secrets.
+func normalizeKey(key string) string {
+	key = strings.ReplaceAll(key, "\r\n", "\n")
+	if key = strings.TrimSpace(key); key != "" {
+		key += "\n"
+	}
+	return key
+}
+
+// AuthenticationHint extends authentication errors with the offered authentication method
+// and a hint on how to resolve them. Other errors are returned unchanged.
+func AuthenticationHint(err error, username string, key string, gssapi bool) error {
+	if !strings.Contains(err.Error(), "unable to authenticate") {
+		return err
+	}
+
+	method, hint := "password", "the password is correct"
+	if gssapi {
+		method, hint = "gssapi-with-mic", "the kerberos principal may log in as this user on the host"
+	} else if key != "" {
+		method, hint = "publickey", "the key is authorized for this user on the host"
+	}
+
+	return fmt.Errorf("%v: offered %s authentication as user %q, please check that the username is correct and that %s", err, method, username, hint)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// checkDeleteExtraneous verifies that deleting extraneous remote files was confirmed, since it
+// deletes everything in the targets that is not part of the upload.
+func checkDeleteExtraneous(direction string) error {
+	if direction != DirectionUpload {
+		return errors.New("deleting extraneous files is only supported for uploads")
+	}
+	if strings.ToLower(strings.TrimSpace(getString("DELETE_EXTRANEOUS_CONFIRM", ""))) != "yes" {
+		return errors.New("delete_extraneous requires delete_extraneous_confirm to be yes")
+	}
+	return nil
+}
+
+// ExtraneousFiles lists the remote paths inside the targets of the groups that are not part of
+// the plan. Planned and skipped files, planned directories and paths that are excluded or
+// hidden relative to the target are kept, as are the directories that contain any of them.
+// Directories that are deleted as a whole are returned without their contents.
+func ExtraneousFiles(client *ssh.Client, transfers *plan, groups []sourceGroup) ([]string, error) {
+	keep := map[string]bool{}
+	suffix, _ := getBackupSuffix()
+	for _, t := range transfers.Transfers {
+		keep[t.Target] = true
+		// The backups of this run are kept for rolling back.
+		if suffix != "" {
+			keep[t.Target+suffix] = true
+		}
+	}
+	for _, t := range transfers.Skipped {
+		keep[t.Target] = true
+	}
+	for _, d := range transfers.Directories {
+		keep[d.Path] = true
+	}
+
+	var roots []string
+	seen := map[string]bool{}
+	for _, group := range groups {
+		root := path.Clean(group.Target)
+		// The target of a renamed file is not a directory to mirror.
+		if seen[root] || keep[root] && !transfers.directories[root] {
+			continue
+		}
+		if root == "/" {
+			return nil, errors.New("refusing to delete extraneous files in /")
+		}
+		seen[root] = true
+		roots = append(roots, root)
+	}
+
+	existing, err := RemoteExists(client, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	var extraneous []string
+	for _, root := range roots {
+		if !existing[root] {
+			continue
+		}
+
+		directories, err := listRemote(client, root, "d", 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list remote directory %s: %v", root, err)
+		}
+		files, err := findRemote(client, root, "! -type d")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list remote directory %s: %v", root, err)
+		}
+
+		// Keep the directories of every path that is kept, so that they are not deleted as a whole.
+		isDirectory := map[string]bool{}
+		for _, dir := range directories {
+			isDirectory[dir] = true
+		}
+		kept := map[string]bool{}
+		for _, relative := range append(directories, files...) {
+			full := path.Join(root, relative)
+			if !keep[full] && !isExcluded(transfers.Exclude, relative, isDirectory[relative]) && !transfers.hidden(relative) {
+				continue
+			}
+			for dir := relative; dir != "."; dir = path.Dir(dir) {
+				kept[dir] = true
+			}
+		}
+
+		var candidates []string
+		for _, relative := range append(directories, files...) {
+			if !kept[relative] {
+				candidates = append(candidates, relative)
+			}
+		}
+		sort.Strings(candidates)
+
+		deleted := map[string]bool{}
+		for _, relative := range candidates {
+			if deleted[path.Dir(relative)] {
+				deleted[relative] = true
+				continue
+			}
+			deleted[relative] = true
+			extraneous = append(extraneous, path.Join(root, relative))
+		}
+	}
+
+	return extraneous, nil
+}
+
+// DeleteRemote deletes the given remote files and directories with batched commands.
+func DeleteRemote(client *ssh.Client, paths []string) error {
+	return RunBatched(client, "rm -rf --", paths)
+}
+
+// dangerousTargets are directories whose contents are never deleted by clean_target.
+var dangerousTargets = map[string]bool{
+	"/": true, ".": true, "~": true, "/bin": true, "/boot": true, "/dev": true, "/etc": true,
+	"/home": true, "/lib": true, "/lib64": true, "/opt": true, "/proc": true, "/root": true,
+	"/run": true, "/sbin": true, "/srv": true, "/sys": true, "/tmp": true, "/usr": true, "/var": true,
+}
+
+// checkCleanTargets verifies that the targets of the groups may be cleaned.
+func checkCleanTargets(direction string, groups []sourceGroup) error {
+	if direction != DirectionUpload {
+		return errors.New("cleaning the target is only supported for uploads")
+	}
+
+	for _, group := range groups {
+		target := strings.TrimSpace(group.Target)
+		if target == "" {
+			return errors.New("refusing to clean an empty target")
+		}
+
+		cleaned := path.Clean(target)
+		if dangerousTargets[cleaned] || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return fmt.Errorf("refusing to clean target %s", target)
+		}
+	}
+	return nil
+}
+
+// CleanTargets deletes the contents of the target directories of the groups, including hidden
+// files, and logs every path before deleting it. Unless dryRun is set, the paths are deleted
+// with batched commands.
+func CleanTargets(client *ssh.Client, groups []sourceGroup, dryRun bool) error {
+	var targets []string
+	seen := map[string]bool{}
+	for _, group := range groups {
+		if target := path.Clean(group.Target); !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	types, err := probeRemotePaths(client, targets)
+	if err != nil {
+		return err
+	}
+
+	for i, target := range targets {
+		// A missing target is empty and the target of a renamed file is not a directory.
+		if types[i] != remoteDirectory {
+			debugf("Not cleaning %s: not a directory", target)
+			continue
+		}
+
+		entries, err := findRemote(client, target, "-maxdepth 1")
+		if err != nil {
+			return fmt.Errorf("failed to list remote directory %s: %v", target, err)
+		}
+
+		paths := make([]string, len(entries))
+		for j, entry := range entries {
+			paths[j] = path.Join(target, entry)
+		}
+		sort.Strings(paths)
+
+		if dryRun {
+			for _, p := range paths {
+				log.Printf("🧹 Would remove %s", p)
+			}
+			continue
+		}
+
+		log.Printf("🧹 Cleaning %s", target)
+		for _, p := range paths {
+			log.Printf("🗑️ Removing %s", p)
+		}
+		if err := DeleteRemote(client, paths); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
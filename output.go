@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// SetOutput sets an output of the action by appending it to the file referenced by GITHUB_OUTPUT.
+// Multi-line values are written with a random delimiter that cannot be part of the value. If
+// GITHUB_OUTPUT is not set, e.g. when running the action locally, the output is logged instead.
+func SetOutput(name string, value string) {
+	filename := os.Getenv("GITHUB_OUTPUT")
+	if filename == "" {
+		log.Printf("📤 Output %s: %s", name, strings.ReplaceAll(value, "\n", "\n    "))
+		return
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("⚠️ Failed to set output %s: %v", name, err)
+		return
+	}
+	defer file.Close()
+
+	line := fmt.Sprintf("%s=%s\n", name, value)
+	if strings.ContainsAny(value, "\r\n") {
+		delimiter, err := outputDelimiter(value)
+		if err != nil {
+			log.Printf("⚠️ Failed to set output %s: %v", name, err)
+			return
+		}
+		line = fmt.Sprintf("%s<<%s\n%s\n%s\n", name, delimiter, value, delimiter)
+	}
+
+	if _, err := file.WriteString(line); err != nil {
+		log.Printf("⚠️ Failed to set output %s: %v", name, err)
+	}
+}
+
+// outputDelimiter generates a random heredoc delimiter that does not occur in the value.
+func outputDelimiter(value string) (string, error) {
+	random := make([]byte, 16)
+	for {
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+
+		if delimiter := "ghadelimiter_" + hex.EncodeToString(random); !strings.Contains(value, delimiter) {
+			return delimiter, nil
+		}
+	}
+}
+
+// readOutputs reads the outputs that were set in the given file, which has the format of
+// GITHUB_OUTPUT.
+func readOutputs(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := map[string]string{}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		if index := strings.Index(lines[i], "<<"); index >= 0 && !strings.Contains(lines[i][:index], "=") {
+			name, delimiter := lines[i][:index], lines[i][index+2:]
+			var value []string
+			for i++; i < len(lines) && lines[i] != delimiter; i++ {
+				value = append(value, lines[i])
+			}
+			outputs[name] = strings.Join(value, "\n")
+			continue
+		}
+
+		if fields := strings.SplitN(lines[i], "=", 2); len(fields) == 2 {
+			outputs[fields[0]] = fields[1]
+		}
+	}
+
+	return outputs, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/crypto/ssh"
+)
+
+// ownerRule applies an owner to the uploaded paths whose remote path matches a pattern.
+type ownerRule struct {
+	Pattern string
+	Owner   string
+}
+
+// fileOwners maps the uploaded paths to their owner.
+type fileOwners struct {
+	// Default is the owner of the paths that match no rule, empty leaves them unchanged unless
+	// the local owner is preserved.
+	Default string
+	Rules   []ownerRule
+	// Strict fails instead of warning if the owner of a path cannot be changed.
+	Strict bool
+}
+
+// getFileOwners parses the owners of the uploaded paths, which are either a single "user" or
+// "user:group" or "pattern=owner" lines, optionally with a single owner line for all other paths.
+// Failures to change an explicit owner are errors unless OWNER_IGNORE_ERRORS is set, failures to
+// preserve the local owner are warnings unless OWNER_STRICT is set. CHOWN is an alias of OWNER.
+func getFileOwners() (fileOwners, error) {
+	owners := fileOwners{Strict: getBool("OWNER_STRICT")}
+	lines := getList("OWNER")
+	if chown := getList("CHOWN"); len(chown) > 0 {
+		lines = chown
+	}
+
+	hasDefault := false
+	for _, line := range lines {
+		pattern, owner, err := splitPatternLine(line)
+		if err != nil {
+			return owners, err
+		}
+		if owner == "" || strings.ContainsAny(owner, " \t") {
+			return owners, fmt.Errorf("invalid owner %q", owner)
+		}
+
+		if pattern != "" {
+			owners.Rules = append(owners.Rules, ownerRule{Pattern: pattern, Owner: owner})
+			continue
+		}
+		if hasDefault {
+			return owners, errors.New("only one owner without a pattern may be given")
+		}
+		owners.Default, hasDefault = owner, true
+	}
+
+	if len(lines) > 0 {
+		owners.Strict = !getBool("OWNER_IGNORE_ERRORS")
+	}
+	return owners, nil
+}
+
+// owner returns the owner of a remote path, which is that of the first rule whose pattern
+// matches the path like an exclude pattern, or the default.
+func (o fileOwners) owner(target string, directory bool) string {
+	for _, rule := range o.Rules {
+		if isExcluded([]string{rule.Pattern}, target, directory) {
+			return rule.Owner
+		}
+	}
+	return o.Default
+}
+
+// splitPatternLine splits a "pattern=value" line of a mapping and validates the pattern. A line
+// without a pattern returns an empty pattern.
+func splitPatternLine(line string) (string, string, error) {
+	i := strings.LastIndex(line, "=")
+	if i < 0 {
+		return "", strings.TrimSpace(line), nil
+	}
+
+	pattern, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+	if pattern == "" {
+		return "", "", fmt.Errorf("missing pattern in %q", line)
+	}
+	if !doublestar.ValidatePattern(strings.Trim(pattern, "/")) {
+		return "", "", fmt.Errorf("invalid pattern %q", pattern)
+	}
+	return pattern, value, nil
+}
+
+// ApplyOwnership changes the owner of the uploaded files and created directories on the remote
+// host and returns the number of changed paths. Paths are grouped by owner, so that each owner
+// takes as few commands as the command line length allows. Paths without an explicit owner keep
+// the owner of their local counterpart if it is preserved.
+func ApplyOwnership(client *ssh.Client, transfers *plan, owners fileOwners) (int, error) {
+	preserve := getBool("PRESERVE_OWNER")
+	if owners.Default == "" && len(owners.Rules) == 0 && !preserve {
+		return 0, nil
+	}
+
+	paths := map[string][]string{}
+	add := func(path string, info os.FileInfo, directory bool) {
+		pathOwner := owners.owner(path, directory)
+		if pathOwner == "" && preserve && info != nil {
+			pathOwner = localOwner(info)
+		}
+		if pathOwner != "" {
+			debugf("Setting owner of %s to %s", path, pathOwner)
+			paths[pathOwner] = append(paths[pathOwner], path)
+		}
+	}
+	for _, d := range transfers.Directories {
+		add(d.Path, d.Info, true)
+	}
+	for _, t := range transfers.Transfers {
+		add(t.Target, t.Info, false)
+	}
+
+	keys := make([]string, 0, len(paths))
+	for key := range paths {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	changed := 0
+	for _, key := range keys {
+		for _, b := range batchCommands("chown -h "+shellQuote(key)+" --", paths[key]) {
+			if _, err := RunCommand(client, b.Command); err != nil {
+				if owners.Strict {
+					return changed, fmt.Errorf("failed to change owner to %s: %v", key, err)
+				}
+				log.Printf("⚠️ Failed to change owner of %d paths to %s: %v", b.Arguments, key, err)
+				continue
+			}
+			changed += b.Arguments
+		}
+	}
+
+	return changed, nil
+}
+
+// modeRule applies a permission mode to the uploaded files whose remote path matches a pattern.
+type modeRule struct {
+	Pattern string
+	Mode    os.FileMode
+}
+
+// fileModes maps the uploaded files to their permission mode.
+type fileModes struct {
+	// Default is the mode of the files that match no rule, zero leaves them unchanged.
+	Default os.FileMode
+	Rules   []modeRule
+}
+
+// getFileModes parses the permission modes of the uploaded files, which are either a single
+// octal mode or "pattern=mode" lines, optionally with a single mode line for all other files.
+// The deprecated CHMOD variable is used if MODE is unset.
+func getFileModes() (fileModes, error) {
+	var modes fileModes
+	lines := getList("MODE")
+	if len(lines) == 0 {
+		lines = getList("CHMOD")
+	}
+
+	hasDefault := false
+	for _, line := range lines {
+		pattern, value, err := splitPatternLine(line)
+		if err != nil {
+			return modes, err
+		}
+
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 07777 {
+			return modes, fmt.Errorf("invalid octal mode: %s", value)
+		}
+
+		if pattern != "" {
+			modes.Rules = append(modes.Rules, modeRule{Pattern: pattern, Mode: os.FileMode(mode)})
+			continue
+		}
+		if hasDefault {
+			return modes, errors.New("only one mode without a pattern may be given")
+		}
+		modes.Default, hasDefault = os.FileMode(mode), true
+	}
+
+	return modes, nil
+}
+
+// single reports whether the same mode applies to all files, so that it can be set when the
+// files are created.
+func (m fileModes) single() bool {
+	return m.Default != 0 && len(m.Rules) == 0
+}
+
+// mode returns the permission mode of a remote file, which is that of the first rule whose
+// pattern matches the path like an exclude pattern, or the default.
+func (m fileModes) mode(target string) os.FileMode {
+	for _, rule := range m.Rules {
+		if isExcluded([]string{rule.Pattern}, target, false) {
+			return rule.Mode
+		}
+	}
+	return m.Default
+}
+
+// ApplyMode changes the permission mode of the uploaded files on the remote host and returns
+// the number of changed files. Files are grouped by mode, so that each mode takes as few
+// commands as the command line length allows. Files without a mode are left unchanged.
+func ApplyMode(client *ssh.Client, transfers *plan, modes fileModes) (int, error) {
+	// The mode of a symlink is that of the file it points to.
+	targets := map[os.FileMode][]string{}
+	for _, t := range regularFiles(transfers.Transfers) {
+		if mode := modes.mode(t.Target); mode != 0 {
+			debugf("Setting mode of %s to %04o", t.Target, mode)
+			targets[mode] = append(targets[mode], t.Target)
+		}
+	}
+
+	var order []os.FileMode
+	for mode := range targets {
+		order = append(order, mode)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+
+	changed := 0
+	for _, mode := range order {
+		for _, b := range batchCommands(fmt.Sprintf("chmod %04o --", mode), targets[mode]) {
+			if _, err := RunCommand(client, b.Command); err != nil {
+				return changed, fmt.Errorf("failed to change mode to %04o: %v", mode, err)
+			}
+			changed += b.Arguments
+		}
+	}
+
+	return changed, nil
+}
+
+// localOwner returns the owner of a local file in the "user:group" format. Names are used
+// if they can be resolved, otherwise the numeric IDs are used.
+func localOwner(info os.FileInfo) string {
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return ""
+	}
+
+	owner, group := strconv.Itoa(uid), strconv.Itoa(gid)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+
+	return owner + ":" + group
+}
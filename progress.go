@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultProgressMinSize is the size above which the progress of a file is logged by default.
+const defaultProgressMinSize = 100 << 20
+
+// progressReader counts the bytes read from a stream.
+type progressReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
+
+// streamedBytes counts the bytes of all streams of file contents.
+var streamedBytes int64
+
+// countingReader adds the bytes read from a stream to streamedBytes.
+type countingReader struct {
+	reader io.Reader
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&streamedBytes, int64(n))
+	return n, err
+}
+
+// trackProgress logs the progress of reading a file of the given size every PROGRESS_INTERVAL,
+// unless the file is smaller than PROGRESS_MIN_SIZE or quiet mode is enabled. The returned
+// function stops logging.
+func trackProgress(name string, size int64, reader io.Reader) (io.Reader, func()) {
+	interval := getDuration("PROGRESS_INTERVAL", 10*time.Second)
+	if interval <= 0 || getBool("QUIET") || size < progressMinSize() {
+		return reader, func() {}
+	}
+
+	progress := &progressReader{reader: reader}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				read := atomic.LoadInt64(&progress.read)
+				log.Printf("⏳ %s: %s / %s (%d%%)", name, formatBytes(read), formatBytes(size), read*100/size)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return progress, func() {
+		close(stop)
+		<-done
+	}
+}
+
+// progressMinSize returns the size above which the progress of a file is logged.
+func progressMinSize() int64 {
+	value := os.Getenv("PROGRESS_MIN_SIZE")
+	if strings.TrimSpace(value) == "" {
+		return defaultProgressMinSize
+	}
+
+	size, err := parseBytes(value)
+	if err != nil {
+		log.Fatalf("❌ Failed to parse progress min size: %v", err)
+	}
+	return int64(size)
+}
+
+// startHeartbeat logs that files are still being transferred every HEARTBEAT_INTERVAL, with the
+// number of completed files out of total as returned by completed. The returned function stops
+// logging and returns once the heartbeat has stopped.
+func startHeartbeat(total int, completed func() int) func() {
+	interval := getDuration("HEARTBEAT_INTERVAL", 5*time.Minute)
+	if interval <= 0 || total == 0 {
+		return func() {}
+	}
+
+	started := time.Now()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				elapsed := time.Since(started).Round(time.Second)
+				log.Printf("💓 Still transferring, %v elapsed, %d/%d files done", elapsed, completed(), total)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// getMinThroughput parses the minimum throughput in bytes per second and the window over which
+// it is measured. A minimum of zero does not limit the throughput.
+func getMinThroughput() (float64, time.Duration, error) {
+	value := os.Getenv("MIN_THROUGHPUT")
+	if strings.TrimSpace(value) == "" {
+		return 0, 0, nil
+	}
+
+	minimum, err := parseRate(value)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	window := getDuration("MIN_THROUGHPUT_WINDOW", time.Minute)
+	if window <= 0 {
+		return 0, 0, fmt.Errorf("invalid min throughput window: %v", window)
+	}
+
+	return minimum, window, nil
+}
+
+// startThroughputWatchdog calls abort if fewer bytes than the minimum throughput allows are
+// streamed during a whole window, e.g. because a transfer is stuck. Slow transfers of large files
+// are not aborted as long as they keep up with the minimum. The returned function stops watching.
+func startThroughputWatchdog(minimum float64, window time.Duration, abort func(error)) func() {
+	if minimum <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		last := atomic.LoadInt64(&streamedBytes)
+		for {
+			select {
+			case <-ticker.C:
+				streamed := atomic.LoadInt64(&streamedBytes)
+				if rate := float64(streamed-last) / window.Seconds(); rate < minimum {
+					abort(fmt.Errorf("throughput of %s/s during the last %v is below the minimum of %s/s", formatBytes(int64(rate)), window, formatBytes(int64(minimum))))
+				}
+				last = streamed
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateUnits maps the units of a size or rate to their number of bytes.
+var rateUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// parseBytes parses a number of bytes, either as an integer or with a unit such as "10MB"
+// or "512KiB".
+func parseBytes(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	number := strings.TrimRightFunc(value, func(r rune) bool { return r >= 'a' && r <= 'z' })
+
+	multiplier, ok := rateUnits[strings.TrimSpace(value[len(number):])]
+	bytes, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if !ok || err != nil || bytes <= 0 {
+		return 0, fmt.Errorf("invalid number of bytes: %s", value)
+	}
+
+	return bytes * multiplier, nil
+}
+
+// parseRate parses a rate in bytes per second, such as "10MB/s".
+func parseRate(value string) (float64, error) {
+	rate, err := parseBytes(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate: %s", value)
+	}
+	return rate, nil
+}
+
+// rateLimiter is a token bucket that bounds the rate of all streams sharing it.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+var (
+	limiter     *rateLimiter
+	limiterOnce sync.Once
+)
+
+// globalLimiter returns the limiter for MAX_RATE shared by all transfers, or nil if the rate
+// is not limited.
+func globalLimiter() *rateLimiter {
+	limiterOnce.Do(func() {
+		value := os.Getenv("MAX_RATE")
+		if strings.TrimSpace(value) == "" {
+			return
+		}
+
+		rate, err := parseRate(value)
+		if err != nil {
+			log.Fatalf("❌ Failed to parse max rate: %v", err)
+		}
+		limiter = &rateLimiter{rate: rate, last: time.Now()}
+	})
+
+	return limiter
+}
+
+// chunk returns the largest number of bytes to take at once, so that a stream waits in small
+// steps rather than for a whole buffer.
+func (l *rateLimiter) chunk() int {
+	chunk := int(l.rate / 10)
+	if chunk < 1024 {
+		return 1024
+	}
+	if chunk > scpBufferSize {
+		return scpBufferSize
+	}
+	return chunk
+}
+
+// wait takes n bytes from the bucket and blocks until they are available. The bucket holds at
+// most one second of tokens.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedReader reads from a stream at the rate of a limiter.
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if chunk := r.limiter.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
+
+// limitRate wraps a stream with the limiter for MAX_RATE, if the rate is limited. The bytes of
+// the stream are counted for the minimum throughput.
+func limitRate(reader io.Reader) io.Reader {
+	reader = &countingReader{reader: reader}
+	if l := globalLimiter(); l != nil {
+		return &limitedReader{reader: reader, limiter: l}
+	}
+	return reader
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// remoteSide describes a remote host as target side of a copy between two remote hosts.
+type remoteSide struct {
+	client *ssh.Client
+}
+
+func (remoteSide) Join(folder string, relative string) string {
+	return path.Join(folder, relative)
+}
+
+func (r remoteSide) IsDir(target string) bool {
+	types, err := probeRemotePaths(r.client, []string{target})
+	return err == nil && types[0] == remoteDirectory
+}
+
+func (remoteSide) DirMode() os.FileMode {
+	return 0
+}
+
+// Relay copies the given groups of files from the source host to the target host. Each file is
+// streamed through the local machine without being stored, like "scp -3".
+func Relay(source *ssh.Client, target *ssh.Client, groups []sourceGroup) {
+	transfers, err := newPlan()
+	if err != nil {
+		log.Fatalf("❌ Failed to relay files: %v", err)
+	}
+	globalLimiter()
+
+	for _, group := range groups {
+		if err := planRemote(source, transfers, group, remoteSide{target}); err != nil {
+			log.Fatalf("❌ Failed to relay files: %v", err)
+		}
+	}
+	if err := transfers.checkRemotePaths(true, true); err != nil {
+		log.Fatalf("❌ Failed to relay files: %v", err)
+	}
+	if allowed := getCommaList("ALLOWED_EXTENSIONS"); len(allowed) > 0 {
+		if err := transfers.checkExtensions(allowed); err != nil {
+			log.Fatalf("❌ Failed to relay files: %v", err)
+		}
+	}
+	if os.Getenv("MAX_FILE_SIZE") != "" {
+		if err := SkipTooLarge(source, transfers, "relay"); err != nil {
+			log.Fatalf("❌ Failed to relay files: %v", err)
+		}
+	}
+	if getBoolDefault("CREATE_TARGET", true) {
+		transfers.addParentDirectories(path.Dir, 0)
+	}
+
+	if getBool("DRY_RUN") {
+		PrintPlan(transfers)
+		return
+	}
+
+	for _, client := range []*ssh.Client{source, target} {
+		if err := CheckRemoteSCP(client); err != nil {
+			log.Fatalf("❌ Failed to relay files: %v", err)
+		}
+	}
+
+	log.Printf("🔁 Relaying ...")
+	if len(transfers.Directories) > 0 {
+		if err := CreateRemoteDirectories(target, transfers.Directories); err != nil {
+			log.Fatalf("❌ Failed to create target directory: %v", err)
+		}
+	}
+
+	results := NewReport("relay")
+	for _, t := range transfers.Skipped {
+		results.Skip(t)
+	}
+
+	planned := len(transfers.Transfers)
+	OnCancel(func() {
+		results.Cancel(planned)
+		source.Close()
+		target.Close()
+	})
+
+	continueOnError := getBool("CONTINUE_ON_ERROR")
+	quiet := getBool("QUIET")
+	var failure error
+	var mu sync.Mutex
+	minThroughput, throughputWindow, err := getMinThroughput()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse min throughput: %v", err)
+	}
+	stopWatchdog := startThroughputWatchdog(minThroughput, throughputWindow, func(err error) {
+		results.Finish()
+		log.Fatalf("❌ Failed to relay files: %v", err)
+	})
+	stopHeartbeat := startHeartbeat(len(transfers.Transfers), results.Completed)
+	forEachParallel(len(transfers.Transfers), getConcurrency(), func(i int) bool {
+		t := transfers.Transfers[i]
+		start := time.Now()
+		n, err := copyRelay(source, target, t.Source, t.Target)
+		if err != nil {
+			results.Fail(t, time.Since(start), err)
+
+			timeout := getDuration("TIMEOUT", defaultTimeout)
+			if continueOnError && !ConnectionLost(source, timeout) && !ConnectionLost(target, timeout) {
+				log.Printf("⚠️ Failed to relay %s: %v", t.Source, err)
+				return true
+			}
+
+			mu.Lock()
+			if failure == nil {
+				failure = err
+			}
+			mu.Unlock()
+			return false
+		}
+		elapsed := time.Since(start)
+		results.Transfer(t, n, elapsed)
+		if !quiet {
+			log.Printf("📑 %s >> %s (%s)", t.Source, t.Target, formatThroughput(n, elapsed))
+		}
+		return true
+	})
+	stopHeartbeat()
+	stopWatchdog()
+	if failure != nil {
+		results.Finish()
+		log.Fatalf("❌ Failed to relay file: %v", failure)
+	}
+
+	results.Finish()
+	results.CheckFailures()
+	results.CheckEmpty()
+}
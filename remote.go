@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RunCommand executes a command on the remote host and returns its standard output.
+// If the command fails, the remote standard error is included in the returned error.
+func RunCommand(client *ssh.Client, command string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	if err := session.Run(command); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return stdout.String(), fmt.Errorf("%v: %s", err, message)
+		}
+		return stdout.String(), err
+	}
+
+	return stdout.String(), nil
+}
+
+// KeepAlive periodically sends keep-alive requests to the remote host until the connection fails.
+func KeepAlive(client *ssh.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			log.Printf("⚠️ Failed to send keep-alive: %v", err)
+			return
+		}
+	}
+}
+
+// ConnectionLost reports whether the remote host no longer responds to keep-alive requests
+// within the timeout, which distinguishes a dropped connection from a failed command.
+// A timeout of zero waits indefinitely.
+func ConnectionLost(client *ssh.Client, timeout time.Duration) bool {
+	replied := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		replied <- err
+	}()
+
+	select {
+	case err := <-replied:
+		return err != nil
+	case <-deadline(timeout):
+		return true
+	}
+}
+
+// preserveCommand returns the commands to append to a command that writes a remote file
+// outside of the scp protocol, so that the file gets the mode and modification time of its
+// local source if these are preserved.
+func preserveCommand(remote string, info os.FileInfo) string {
+	var command string
+	if getBool("PRESERVE_MODE") {
+		command += fmt.Sprintf(" && chmod %04o %s", info.Mode().Perm(), shellQuote(remote))
+	}
+	if getBool("PRESERVE_TIMES") {
+		command += fmt.Sprintf(" && TZ=UTC touch -m -t %s %s", info.ModTime().UTC().Format("200601021504.05"), shellQuote(remote))
+	}
+	return command
+}
+
+// shellQuote wraps a value in single quotes so that it is passed verbatim to a POSIX shell,
+// whatever spaces, quotes or other metacharacters it contains. Every remote path that is part
+// of a remote command is quoted with it.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// checkRemotePath rejects a remote path containing a newline, which the scp protocol and the
+// line-based output of remote commands cannot represent.
+func checkRemotePath(p string) error {
+	if strings.Contains(p, "\n") {
+		return fmt.Errorf("remote path %q contains a newline", p)
+	}
+	return nil
+}
+
+// maxCommandLength limits the length of a single batched remote command line.
+const maxCommandLength = 64 * 1024
+
+// batch is a command line with a number of arguments appended.
+type batch struct {
+	Command   string
+	Arguments int
+}
+
+// batchCommands appends the quoted arguments to a command, splitting them across as
+// few command lines as the maximum command line length allows.
+func batchCommands(command string, arguments []string) []batch {
+	var batches []batch
+	current := batch{Command: command}
+	for _, argument := range arguments {
+		quoted := shellQuote(argument)
+		if current.Arguments > 0 && len(current.Command)+len(quoted)+1 > maxCommandLength {
+			batches = append(batches, current)
+			current = batch{Command: command}
+		}
+		current.Command += " " + quoted
+		current.Arguments++
+	}
+
+	if current.Arguments > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
+// RunBatched runs a command on the remote host with the given arguments appended.
+// The arguments are quoted and split across as few invocations as the command line length allows.
+func RunBatched(client *ssh.Client, command string, arguments []string) error {
+	for _, b := range batchCommands(command, arguments) {
+		if _, err := RunCommand(client, b.Command); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoteExists determines which of the given remote paths exist.
+func RemoteExists(client *ssh.Client, paths []string) (map[string]bool, error) {
+	records, err := forEachRemote(client, paths, `if [ -e "$p" ] || [ -L "$p" ]; then printf '%s\0' "$p"; fi`)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, p := range records {
+		existing[p] = true
+	}
+
+	return existing, nil
+}
+
+// remoteFileInfo describes a remote file.
+type remoteFileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// RemoteStat determines the size and modification time of the given remote paths, omitting missing paths.
+func RemoteStat(client *ssh.Client, paths []string) (map[string]remoteFileInfo, error) {
+	records, err := forEachRemote(client, paths, `if [ -e "$p" ]; then s=$(stat -L -c '%s %Y' -- "$p" 2>/dev/null || stat -L -f '%z %m' -- "$p") && printf '%s %s\0' "$s" "$p"; fi`)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := map[string]remoteFileInfo{}
+	for _, record := range records {
+		fields := strings.SplitN(record, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected output while reading file information: %q", record)
+		}
+
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output while reading file information: %q", record)
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output while reading file information: %q", record)
+		}
+		infos[fields[2]] = remoteFileInfo{Size: size, ModTime: time.Unix(seconds, 0)}
+	}
+
+	return infos, nil
+}
+
+// forEachRemote runs a shell loop body for each of the given remote paths, which is available
+// as $p, using as few invocations as the command line length allows. It returns the
+// NUL-terminated records printed by the body.
+func forEachRemote(client *ssh.Client, paths []string, body string) ([]string, error) {
+	var records []string
+	for _, b := range batchCommands("for p in", paths) {
+		output, err := RunCommand(client, b.Command+"; do "+body+"; done")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range strings.Split(output, "\x00") {
+			if record != "" {
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+var quotedValues = []string{
+	"",
+	"plain",
+	"with spaces",
+	"it's",
+	"''",
+	`double "quotes"`,
+	"$HOME and ${PATH}",
+	"`id` and $(id)",
+	`back\slash`,
+	"semi;colon && pipe | amp &",
+	"glob * ? [a-z] ~",
+	"tab\tand\rreturn",
+	"ünïcödé ✓",
+	"-n",
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected string
+	}{
+		{"", "''"},
+		{"plain", "'plain'"},
+		{"with spaces", "'with spaces'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+	} {
+		if actual := shellQuote(test.value); actual != test.expected {
+			t.Errorf("shellQuote(%q) is %s, expected %s", test.value, actual, test.expected)
+		}
+	}
+}
+
+func TestShellQuoteRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+
+	for _, value := range quotedValues {
+		output, err := exec.Command("sh", "-c", "printf %s "+shellQuote(value)).Output()
+		if err != nil {
+			t.Errorf("shell failed to evaluate %s: %v", shellQuote(value), err)
+			continue
+		}
+		if actual := string(output); actual != value {
+			t.Errorf("shell evaluated %s to %q, expected %q", shellQuote(value), actual, value)
+		}
+	}
+}
+
+func TestCheckRemotePath(t *testing.T) {
+	for _, value := range quotedValues {
+		if err := checkRemotePath(value); err != nil {
+			t.Errorf("checkRemotePath(%q) failed: %v", value, err)
+		}
+	}
+	for _, value := range []string{"line\nbreak", "trailing\n", "\n"} {
+		if err := checkRemotePath(value); err == nil {
+			t.Errorf("checkRemotePath(%q) succeeded, expected an error", value)
+		}
+	}
+}
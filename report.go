@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statuses of a file in the report.
+const (
+	statusTransferred = "transferred"
+	statusSkipped     = "skipped"
+	statusFailed      = "failed"
+)
+
+// result describes the outcome for a single file.
+type result struct {
+	Source   string  `json:"source"`
+	Target   string  `json:"target"`
+	Status   string  `json:"status"`
+	Reason   string  `json:"reason,omitempty"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+	// Rate is the number of bytes per second of a transferred file.
+	Rate float64 `json:"bytes_per_second,omitempty"`
+	// SHA256 is the verified digest of a transferred file.
+	SHA256 string `json:"sha256,omitempty"`
+	// CompressedBytes is the size of a transferred file after compression.
+	CompressedBytes int64 `json:"compressed_bytes,omitempty"`
+	// ReusedBytes is the part of a resumed file that was kept from an earlier transfer.
+	ReusedBytes int64 `json:"reused_bytes,omitempty"`
+	// Backup is the path to which the previous target was copied before it was overwritten.
+	Backup string `json:"backup,omitempty"`
+}
+
+// totals summarizes the outcome of a run.
+type totals struct {
+	Transferred int     `json:"transferred"`
+	Skipped     int     `json:"skipped"`
+	Failed      int     `json:"failed"`
+	Bytes       int64   `json:"bytes"`
+	Duration    float64 `json:"duration_seconds"`
+	// Rate is the average number of bytes per second while files were being transferred.
+	Rate float64 `json:"bytes_per_second"`
+	// Directories counts the target directories that were created if missing.
+	Directories int `json:"directories,omitempty"`
+	// Identical counts the skipped files whose target already had the same content.
+	Identical int `json:"identical,omitempty"`
+	// CompressedBytes is the total size of the files that were compressed, after compression.
+	CompressedBytes int64 `json:"compressed_bytes,omitempty"`
+	// ReusedBytes is the total size of the parts of resumed files that were not transferred again.
+	ReusedBytes int64 `json:"reused_bytes,omitempty"`
+	// Backups counts the existing targets that were backed up before being overwritten.
+	Backups int `json:"backups,omitempty"`
+	// OwnershipChanges counts the remote paths whose owner was changed.
+	OwnershipChanges int `json:"ownership_changes,omitempty"`
+}
+
+// report collects the results of all files of a run.
+type report struct {
+	Direction string   `json:"direction"`
+	Host      string   `json:"host"`
+	Files     []result `json:"files"`
+	Totals    totals   `json:"totals"`
+
+	// Backups maps the targets that were backed up to their backups.
+	Backups map[string]string `json:"-"`
+
+	// mu guards the files and totals, which are recorded by concurrent transfers.
+	mu      sync.Mutex
+	started time.Time
+	// first and last bound the time during which files were being transferred.
+	first time.Time
+	last  time.Time
+	// finished is set once the results were logged and written.
+	finished bool
+}
+
+// NewReport creates a report for a run in the given direction.
+func NewReport(direction string) *report {
+	return &report{Direction: direction, Host: os.Getenv("HOST"), Files: []result{}, started: time.Now()}
+}
+
+// Transfer records a successfully transferred file.
+func (r *report) Transfer(t transfer, bytes int64, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file := result{Source: t.Source, Target: t.Target, Status: statusTransferred, Bytes: bytes, Duration: duration.Seconds(), Backup: r.Backups[t.Target]}
+	if duration > 0 {
+		file.Rate = float64(bytes) / duration.Seconds()
+	}
+	r.Files = append(r.Files, file)
+	r.Totals.Transferred++
+	r.Totals.Bytes += bytes
+
+	end := time.Now()
+	if start := end.Add(-duration); r.first.IsZero() || start.Before(r.first) {
+		r.first = start
+	}
+	if end.After(r.last) {
+		r.last = end
+	}
+}
+
+// Skip records a file that was not transferred.
+func (r *report) Skip(t transfer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Files = append(r.Files, result{Source: t.Source, Target: t.Target, Status: statusSkipped, Reason: t.Skip})
+	r.Totals.Skipped++
+	if t.Skip == skipIdentical {
+		r.Totals.Identical++
+	}
+}
+
+// Fail records a file that failed to transfer.
+func (r *report) Fail(t transfer, duration time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Files = append(r.Files, result{Source: t.Source, Target: t.Target, Status: statusFailed, Reason: err.Error(), Duration: duration.Seconds(), Backup: r.Backups[t.Target]})
+	r.Totals.Failed++
+}
+
+// Completed returns the number of files that were transferred or failed.
+func (r *report) Completed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Totals.Transferred + r.Totals.Failed
+}
+
+// Checksums records the verified digests of the transferred files by source path.
+func (r *report) Checksums(digests map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, file := range r.Files {
+		if file.Status == statusTransferred {
+			r.Files[i].SHA256 = digests[file.Source]
+		}
+	}
+}
+
+// Compressed records the compressed sizes of the transferred files by source path.
+func (r *report) Compressed(sizes map[string]int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, file := range r.Files {
+		if size, ok := sizes[file.Source]; ok && file.Status == statusTransferred {
+			r.Files[i].CompressedBytes = size
+			r.Totals.CompressedBytes += size
+		}
+	}
+}
+
+// Resumed records the bytes of the transferred files that were kept from an earlier transfer
+// by source path.
+func (r *report) Resumed(reused map[string]int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, file := range r.Files {
+		if bytes, ok := reused[file.Source]; ok && file.Status == statusTransferred {
+			r.Files[i].ReusedBytes = bytes
+			r.Totals.ReusedBytes += bytes
+		}
+	}
+}
+
+// Finish logs the summary of the run, sets the action outputs and writes the summary file.
+func (r *report) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.finished {
+		return
+	}
+	r.finished = true
+	r.Totals.Backups = len(r.Backups)
+
+	r.Totals.Duration = time.Since(r.started).Seconds()
+
+	elapsed := r.last.Sub(r.first)
+	if elapsed > 0 {
+		r.Totals.Rate = float64(r.Totals.Bytes) / elapsed.Seconds()
+	}
+
+	summary := fmt.Sprintf("📡 Transferred %d files (%s)", r.Totals.Transferred, formatThroughput(r.Totals.Bytes, elapsed))
+	if r.Totals.Transferred == 1 {
+		summary = fmt.Sprintf("📡 Transferred 1 file (%s)", formatThroughput(r.Totals.Bytes, elapsed))
+	}
+	if r.Totals.Directories == 1 {
+		summary += ", created 1 directory"
+	} else if r.Totals.Directories > 1 {
+		summary += fmt.Sprintf(", created %d directories", r.Totals.Directories)
+	}
+	if r.Totals.CompressedBytes > 0 {
+		summary += fmt.Sprintf(", compressed to %s", formatBytes(r.Totals.CompressedBytes))
+	}
+	if r.Totals.ReusedBytes > 0 {
+		summary += fmt.Sprintf(", reused %s", formatBytes(r.Totals.ReusedBytes))
+	}
+	if r.Totals.Backups > 0 {
+		summary += fmt.Sprintf(", backed up %d", r.Totals.Backups)
+	}
+	if r.Totals.Skipped > 0 {
+		summary += fmt.Sprintf(", skipped %d (%s)", r.Totals.Skipped, r.skipReasons())
+	}
+	if r.Totals.Failed > 0 {
+		summary += fmt.Sprintf(", failed %d", r.Totals.Failed)
+	}
+	log.Println(summary)
+
+	SetOutput("transferred_count", fmt.Sprint(r.Totals.Transferred))
+	SetOutput("succeeded_count", fmt.Sprint(r.Totals.Transferred))
+	SetOutput("failed_count", fmt.Sprint(r.Totals.Failed))
+	SetOutput("skipped_count", fmt.Sprint(r.Totals.Skipped))
+	SetOutput("identical_count", fmt.Sprint(r.Totals.Identical))
+	SetOutput("directories_count", fmt.Sprint(r.Totals.Directories))
+	SetOutput("total_bytes", fmt.Sprint(r.Totals.Bytes))
+	SetOutput("compressed_bytes", fmt.Sprint(r.Totals.CompressedBytes))
+	SetOutput("reused_bytes", fmt.Sprint(r.Totals.ReusedBytes))
+	SetOutput("duration_seconds", fmt.Sprintf("%.3f", r.Totals.Duration))
+	SetOutput("bytes_per_second", fmt.Sprintf("%.0f", r.Totals.Rate))
+
+	var targets []string
+	for _, file := range r.Files {
+		if file.Status == statusTransferred {
+			targets = append(targets, file.Target)
+		}
+	}
+	SetOutput("transferred_files", strings.Join(targets, "\n"))
+
+	// List verified digests in the format of sha256sum.
+	var checksums []string
+	for _, file := range r.Files {
+		if file.SHA256 != "" {
+			checksums = append(checksums, file.SHA256+"  "+file.Target)
+		}
+	}
+	if len(checksums) > 0 {
+		SetOutput("checksums", strings.Join(checksums, "\n"))
+	}
+
+	if filename := os.Getenv("GITHUB_STEP_SUMMARY"); filename != "" {
+		if err := r.writeStepSummary(filename, elapsed); err != nil {
+			log.Printf("⚠️ Failed to write job summary: %v", err)
+		}
+	}
+
+	if filename := os.Getenv("SUMMARY_FILE"); filename != "" {
+		if err := r.write(filename); err != nil {
+			log.Printf("⚠️ Failed to write summary file: %v", err)
+		}
+	}
+
+	if filename := os.Getenv("METRICS_FILE"); filename != "" {
+		if err := r.writeMetrics(filename); err != nil {
+			log.Printf("⚠️ Failed to write metrics file: %v", err)
+		}
+	}
+}
+
+// Cancel logs how many of the planned files were completed and finishes the report, unless it
+// is already finished.
+func (r *report) Cancel(planned int) {
+	r.mu.Lock()
+	finished := r.finished
+	completed := r.Totals.Transferred + r.Totals.Failed
+	r.mu.Unlock()
+
+	if !finished {
+		log.Printf("🛑 Cancelled after %d of %d files", completed, planned)
+		r.Finish()
+	}
+}
+
+// CheckFailures lists the files that failed to transfer with their errors and exits with a
+// non-zero status if there are any, unless failures are treated as warnings.
+func (r *report) CheckFailures() {
+	if r.Totals.Failed == 0 {
+		return
+	}
+
+	warn := getBool("FAILURES_AS_WARNINGS")
+	emoji := "❌"
+	if warn {
+		emoji = "⚠️"
+	}
+
+	log.Printf("%s Failed to transfer %d files:", emoji, r.Totals.Failed)
+	for _, file := range r.Files {
+		if file.Status == statusFailed {
+			log.Printf("%s %s: %s", emoji, file.Source, file.Reason)
+		}
+	}
+
+	if !warn {
+		os.Exit(1)
+	}
+}
+
+// CheckEmpty fails if no files were transferred and empty runs are not allowed, e.g. because
+// all sources were skipped.
+func (r *report) CheckEmpty() {
+	if r.Totals.Transferred == 0 && getBool("FAIL_ON_EMPTY") {
+		log.Fatalf("❌ Failed to %s files: %v", r.Direction, errors.New("no files were transferred"))
+	}
+}
+
+// skipReasons lists how many files were skipped for each reason.
+func (r *report) skipReasons() string {
+	counts := map[string]int{}
+	for _, file := range r.Files {
+		if file.Status == statusSkipped {
+			counts[file.Reason]++
+		}
+	}
+
+	reasons := make([]string, 0, len(counts))
+	for reason, count := range counts {
+		reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+	}
+	sort.Strings(reasons)
+
+	return strings.Join(reasons, ", ")
+}
+
+// writeStepSummary appends a Markdown table of all files to the job summary. Failed and skipped
+// files are listed first, and the table is truncated to STEP_SUMMARY_ROWS rows.
+func (r *report) writeStepSummary(filename string, elapsed time.Duration) error {
+	rows := getInt("STEP_SUMMARY_ROWS", 100)
+	order := map[string]int{statusFailed: 0, statusSkipped: 1, statusTransferred: 2}
+	files := append([]result{}, r.Files...)
+	sort.SliceStable(files, func(i, j int) bool { return order[files[i].Status] < order[files[j].Status] })
+
+	var summary strings.Builder
+	preposition := "to"
+	if r.Direction == DirectionDownload {
+		preposition = "from"
+	}
+	fmt.Fprintf(&summary, "### SCP %s %s %s\n\n", r.Direction, preposition, r.Host)
+	fmt.Fprintf(&summary, "%d transferred (%s), %d skipped, %d failed\n\n", r.Totals.Transferred, formatThroughput(r.Totals.Bytes, elapsed), r.Totals.Skipped, r.Totals.Failed)
+	summary.WriteString("| Status | Source | Target | Size | Duration |\n| --- | --- | --- | --- | --- |\n")
+	for i, file := range files {
+		if i == rows {
+			fmt.Fprintf(&summary, "\n_and %d more files_\n", len(files)-rows)
+			break
+		}
+
+		status, size, duration := "✅ transferred", formatBytes(file.Bytes), time.Duration(file.Duration*float64(time.Second)).Round(time.Millisecond).String()
+		switch file.Status {
+		case statusSkipped:
+			status, size, duration = "⏭️ **skipped**: "+file.Reason, "", ""
+		case statusFailed:
+			status, size = "❌ **failed**: "+file.Reason, ""
+		}
+		target := markdownCell(file.Target)
+		if file.Backup != "" {
+			target += "<br>backup: " + markdownCell(file.Backup)
+		}
+		fmt.Fprintf(&summary, "| %s | %s | %s | %s | %s |\n", markdownCell(status), markdownCell(file.Source), target, size, duration)
+	}
+	summary.WriteString("\n")
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(summary.String())
+	return err
+}
+
+// markdownCell escapes a value for a cell of a Markdown table.
+func markdownCell(value string) string {
+	return strings.NewReplacer("|", "\\|", "\r", " ", "\n", " ").Replace(value)
+}
+
+// write stores the report as a JSON document.
+func (r *report) write(filename string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// writeMetrics writes the totals in the Prometheus text format, e.g. for the textfile collector
+// of node_exporter. The file is replaced at once, so that the collector never reads a partial
+// file.
+func (r *report) writeMetrics(filename string) error {
+	labels := fmt.Sprintf(`{direction="%s",host="%s"}`, metricLabel(r.Direction), metricLabel(r.Host))
+	metrics := []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"scp_files_transferred_total", "counter", "Number of transferred files.", float64(r.Totals.Transferred)},
+		{"scp_bytes_transferred_total", "counter", "Number of transferred bytes.", float64(r.Totals.Bytes)},
+		{"scp_failures_total", "counter", "Number of files that failed to transfer.", float64(r.Totals.Failed)},
+		{"scp_files_skipped_total", "counter", "Number of skipped files.", float64(r.Totals.Skipped)},
+		{"scp_transfer_duration_seconds", "gauge", "Duration of the run in seconds.", r.Totals.Duration},
+	}
+
+	var buffer strings.Builder
+	for _, metric := range metrics {
+		fmt.Fprintf(&buffer, "# HELP %s %s\n# TYPE %s %s\n%s%s %g\n", metric.name, metric.help, metric.name, metric.kind, metric.name, labels, metric.value)
+	}
+
+	temporary := filename + ".tmp"
+	if err := ioutil.WriteFile(temporary, []byte(buffer.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, filename)
+}
+
+// metricLabel escapes a value of a Prometheus label.
+func metricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
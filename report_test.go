@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestReportRecordsConcurrently(t *testing.T) {
+	r := NewReport("upload")
+	digests := map[string]string{}
+	sizes := map[string]int64{}
+	reused := map[string]int64{}
+	for i := 0; i < 100; i++ {
+		source := fmt.Sprintf("file%d", i)
+		digests[source], sizes[source], reused[source] = "digest", 1, 2
+	}
+
+	// The results of a stage are recorded while later files are still being transferred.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.Transfer(transfer{Source: fmt.Sprintf("file%d", i)}, 10, 0)
+		}(i)
+	}
+	for _, record := range []func(){
+		func() { r.Checksums(digests) },
+		func() { r.Compressed(sizes) },
+		func() { r.Resumed(reused) },
+	} {
+		wg.Add(1)
+		go func(record func()) {
+			defer wg.Done()
+			record()
+		}(record)
+	}
+	wg.Wait()
+
+	if len(r.Files) != 100 {
+		t.Fatalf("recorded %d files, expected 100", len(r.Files))
+	}
+	for _, file := range r.Files {
+		if file.Status != statusTransferred {
+			t.Errorf("status of %s is %s, expected %s", file.Source, file.Status, statusTransferred)
+		}
+	}
+	if r.Totals.CompressedBytes > 100 || r.Totals.ReusedBytes > 200 {
+		t.Errorf("recorded %d compressed and %d reused bytes, expected at most 100 and 200", r.Totals.CompressedBytes, r.Totals.ReusedBytes)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// resumer continues transfers of files that were partially transferred before, e.g. by an
+// interrupted run or a failed attempt, instead of transferring them again from the start.
+type resumer struct {
+	// full copies a file from the start.
+	full copyFunc
+
+	// mu guards reused, which maps the sources of resumed files to the bytes that were kept.
+	mu     sync.Mutex
+	reused map[string]int64
+}
+
+// newResumer creates a resumer that falls back to the given copy for files that cannot be resumed.
+func newResumer(full copyFunc) *resumer {
+	return &resumer{full: full, reused: map[string]int64{}}
+}
+
+// upload appends the remainder of a local file to a shorter remote file that holds its
+// beginning, or uploads the whole file if there is nothing to resume. A remote file that
+// already holds the whole local file is not uploaded again.
+func (r *resumer) upload(client *ssh.Client, local string, remote string) (int64, error) {
+	info, err := os.Stat(local)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, ok, err := remoteFileSize(client, remote)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || offset == 0 || offset > info.Size() {
+		return r.full(client, local, remote)
+	}
+
+	// Only a remote file that matches the beginning of the local file is extended.
+	same, err := samePrefix(client, local, remote, offset)
+	if err != nil {
+		log.Printf("⚠️ Uploading %s again, because the remote file cannot be compared: %v", local, err)
+		return r.full(client, local, remote)
+	}
+	if !same {
+		log.Printf("⚠️ Uploading %s again, because the remote file %s differs from it", local, remote)
+		return r.full(client, local, remote)
+	}
+
+	var n int64
+	r.reuse(local, offset)
+	if offset == info.Size() {
+		log.Printf("⏩ Remote file %s is already complete", remote)
+	} else {
+		log.Printf("⏩ Resuming %s at %s of %s", local, formatBytes(offset), formatBytes(info.Size()))
+		if n, err = appendRemote(client, local, remote, offset, info.Size()); err != nil {
+			return n, err
+		}
+	}
+
+	size, _, err := remoteFileSize(client, remote)
+	if err != nil {
+		return n, err
+	}
+	if size != info.Size() {
+		return n, fmt.Errorf("size mismatch after resuming: expected %d bytes, remote file has %d", info.Size(), size)
+	}
+
+	if command := preserveCommand(remote, info); command != "" {
+		if _, err := RunCommand(client, "true"+command); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// download appends the remainder of a remote file to a shorter local file, or downloads the
+// whole file if there is nothing to resume. A local file that is larger than the remote one
+// is assumed to be corrupt and downloaded again.
+func (r *resumer) download(client *ssh.Client, remote string, local string) (int64, error) {
+	info, err := os.Stat(local)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return r.full(client, remote, local)
+	}
+
+	size, ok, err := remoteFileSize(client, remote)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return r.full(client, remote, local)
+	}
+	offset := info.Size()
+	if offset > size {
+		log.Printf("⚠️ Local file %s is larger than %s, downloading it again", local, remote)
+		return r.full(client, remote, local)
+	}
+
+	log.Printf("⏩ Resuming %s at %s of %s", remote, formatBytes(offset), formatBytes(size))
+	r.reuse(remote, offset)
+	n, err := appendLocal(client, remote, local, offset, size)
+	if err != nil {
+		return n, err
+	}
+
+	if info, err = os.Stat(local); err != nil {
+		return n, err
+	}
+	if info.Size() != size {
+		return n, fmt.Errorf("size mismatch after resuming: expected %d bytes, local file has %d", size, info.Size())
+	}
+
+	if getBool("PRESERVE_TIMES") {
+		remoteInfo, err := RemoteStat(client, []string{remote})
+		if err != nil {
+			return n, err
+		}
+		if stat, ok := remoteInfo[remote]; ok {
+			if err := os.Chtimes(local, stat.ModTime, stat.ModTime); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// samePrefix reports whether the remote file has the same digest as the first size bytes of
+// the local file.
+func samePrefix(client *ssh.Client, local string, remote string, size int64) (bool, error) {
+	localDigest, err := localPrefixChecksum(local, size)
+	if err != nil {
+		return false, err
+	}
+	remoteDigest, err := remotePrefixChecksum(client, remote, size)
+	if err != nil {
+		return false, err
+	}
+
+	debugf("Comparing %s with digest %s to %s with digest %s", local, localDigest, remote, remoteDigest)
+	return localDigest == remoteDigest, nil
+}
+
+// reuse records the number of bytes of a source that were kept from an earlier transfer.
+func (r *resumer) reuse(source string, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reused[source] = bytes
+}
+
+// SkipComplete skips downloads whose local target already has the size of its remote source,
+// e.g. because an earlier run downloaded it completely before failing on another file.
+func SkipComplete(client *ssh.Client, transfers *plan) error {
+	remote, err := RemoteStat(client, transfers.sourcePaths())
+	if err != nil {
+		return err
+	}
+
+	return transfers.skipTransfers(func(t transfer) (string, error) {
+		info, err := os.Stat(t.Target)
+		if err != nil || !info.Mode().IsRegular() {
+			return "", nil
+		}
+		if source, ok := remote[t.Source]; ok && source.Size == info.Size() {
+			return skipComplete, nil
+		}
+		return "", nil
+	})
+}
+
+// remoteFileSize returns the size of a regular remote file and whether it exists.
+func remoteFileSize(client *ssh.Client, remote string) (int64, bool, error) {
+	p := shellQuote(remote)
+	output, err := RunCommand(client, "if [ -f "+p+" ]; then stat -L -c %s -- "+p+" 2>/dev/null || stat -L -f %z -- "+p+"; fi")
+	if err != nil {
+		return 0, false, err
+	}
+
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return 0, false, nil
+	}
+
+	size, err := strconv.ParseInt(output, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("unexpected output while reading file size: %q", output)
+	}
+	return size, true, nil
+}
+
+// appendRemote streams a local file from the offset to its size to the end of a remote file.
+func appendRemote(client *ssh.Client, local string, remote string, offset int64, size int64) (int64, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	stderr := &syncBuffer{}
+	session.Stderr = stderr
+
+	if err := session.Start("cat >> " + shellQuote(remote)); err != nil {
+		return 0, err
+	}
+
+	n, err := streamFile(local, size-offset, stdin, file)
+	stdin.Close()
+
+	if waitErr := session.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return n, fmt.Errorf("%v: %s", err, message)
+		}
+		return n, err
+	}
+	if n != size-offset {
+		return n, fmt.Errorf("file changed during transfer: expected %d bytes, read %d", size-offset, n)
+	}
+
+	return n, nil
+}
+
+// appendLocal streams a remote file from the offset to its size to the end of a local file. The
+// remote file is read with tail, since the scp protocol cannot start at an offset.
+func appendLocal(client *ssh.Client, remote string, local string, offset int64, size int64) (int64, error) {
+	file, err := os.OpenFile(local, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	stderr := &syncBuffer{}
+	session.Stderr = stderr
+
+	if err := session.Start(fmt.Sprintf("tail -c +%d -- %s", offset+1, shellQuote(remote))); err != nil {
+		return 0, err
+	}
+
+	n, err := streamFile(remote, size-offset, file, stdout)
+	if err != nil {
+		return n, err
+	}
+	// A remote file that grew since its size was read is drained, so that tail can exit.
+	extra, _ := io.Copy(ioutil.Discard, stdout)
+
+	if err := session.Wait(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return n, fmt.Errorf("%v: %s", err, message)
+		}
+		return n, err
+	}
+	if n != size-offset {
+		return n, fmt.Errorf("unexpected end of file: expected %d bytes, received %d", size-offset, n)
+	}
+	if extra > 0 {
+		return n, fmt.Errorf("file changed during transfer: expected %d bytes, received %d", size-offset, n+extra)
+	}
+	if err := file.Close(); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeUploadComparesRemoteFile(t *testing.T) {
+	client := startTestServer(t)
+	for _, program := range []string{"head", "sha256sum"} {
+		if _, err := exec.LookPath(program); err != nil {
+			t.Skipf("%s is not installed", program)
+		}
+	}
+	unsetEnv(t, "PRESERVE_TIMES", "PRESERVE_MODE", "MODE", "CHMOD")
+
+	content := "0123456789abcdefghij"
+	for _, test := range []struct {
+		name   string
+		remote string
+		sent   int64
+		reused int64
+	}{
+		{"matching beginning", content[:8], int64(len(content) - 8), 8},
+		{"different beginning", "0123X567", int64(len(content)), 0},
+		{"complete", content, 0, int64(len(content))},
+		{"longer", content + "klm", int64(len(content)), 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			local, remote := filepath.Join(dir, "local.txt"), filepath.Join(dir, "remote.txt")
+			if err := ioutil.WriteFile(local, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(remote, []byte(test.remote), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			r := newResumer(copyTo)
+			n, err := r.upload(client, local, remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != test.sent {
+				t.Errorf("sent %d bytes, expected %d", n, test.sent)
+			}
+			if actual := r.reused[local]; actual != test.reused {
+				t.Errorf("reused %d bytes, expected %d", actual, test.reused)
+			}
+
+			uploaded, err := ioutil.ReadFile(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := string(uploaded); actual != content {
+				t.Errorf("remote file is %q, expected %q", actual, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// scpBufferSize is the size of the buffer used to stream file contents, which bounds the memory
+	// used per transfer whatever the size of the file.
+	scpBufferSize = 256 * 1024
+	// scpFileMode is the permission mode of uploaded files, unless modes are preserved.
+	scpFileMode = 0644
+	// scpExitTimeout is how long to wait for the remote scp program to exit after an error.
+	scpExitTimeout = time.Second
+)
+
+// scpSession wraps a remote scp process and its protocol streams.
+type scpSession struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	stderr  *syncBuffer
+	// exited is closed once the remote scp program has exited with exitErr.
+	exited  chan struct{}
+	exitErr error
+}
+
+// syncBuffer is a buffer that may be written while it is being read.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+// streamFile copies the content of a file of the given size from the reader to the writer at
+// the limited rate, logging its progress. The content is streamed through a buffer of
+// scpBufferSize, unless the writer reads it in chunks of its own.
+func streamFile(name string, size int64, w io.Writer, r io.Reader) (int64, error) {
+	reader, stop := trackProgress(name, size, limitRate(io.LimitReader(r, size)))
+	defer stop()
+	return io.CopyBuffer(w, reader, make([]byte, scpBufferSize))
+}
+
+// startSCP starts the remote scp program with the given arguments.
+func startSCP(client *ssh.Client, arguments string) (*scpSession, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &scpSession{session: session, stderr: &syncBuffer{}, exited: make(chan struct{})}
+	session.Stderr = s.stderr
+	if s.stdin, err = session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	s.stdout = bufio.NewReaderSize(stdout, scpBufferSize)
+
+	if err := session.Start(scpCommand() + " " + arguments); err != nil {
+		session.Close()
+		return nil, err
+	}
+	go func() {
+		s.exitErr = session.Wait()
+		close(s.exited)
+	}()
+
+	return s, nil
+}
+
+// scpCommand returns the quoted name or path of the remote scp program.
+func scpCommand() string {
+	if program := os.Getenv("REMOTE_SCP_PATH"); program != "" {
+		return shellQuote(program)
+	}
+	return "scp"
+}
+
+// CheckRemoteSCP verifies that a configured remote scp program can be found on the remote host.
+func CheckRemoteSCP(client *ssh.Client) error {
+	program := os.Getenv("REMOTE_SCP_PATH")
+	if program == "" {
+		return nil
+	}
+
+	if _, err := RunCommand(client, "command -v "+shellQuote(program)); err != nil {
+		return fmt.Errorf("remote scp program %s not found", program)
+	}
+	return nil
+}
+
+// close terminates the session and waits for the remote scp program to exit.
+func (s *scpSession) close() {
+	s.stdin.Close()
+	<-s.exited
+	s.session.Close()
+}
+
+// fail returns an error that includes the remote standard error verbatim, if there is any,
+// or otherwise the exit status of the remote scp program if the stream ended unexpectedly.
+// As the remote program usually exits after reporting an error, it is given a moment to do
+// so, so that its standard error is complete.
+func (s *scpSession) fail(err error) error {
+	s.stdin.Close()
+	select {
+	case <-s.exited:
+	case <-time.After(scpExitTimeout):
+	}
+
+	if message := strings.TrimRight(s.stderr.String(), "\r\n"); message != "" && !strings.Contains(err.Error(), strings.TrimSpace(message)) {
+		return fmt.Errorf("%v: %s", err, message)
+	}
+
+	// Without a message, the exit status is the only hint why the stream ended.
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	select {
+	case <-s.exited:
+		if s.exitErr != nil {
+			return fmt.Errorf("%v: %v", err, s.exitErr)
+		}
+	default:
+	}
+	return err
+}
+
+// readAck reads a protocol acknowledgement and converts remote warnings and errors into errors.
+func (s *scpSession) readAck() error {
+	code, err := s.stdout.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+
+	message, err := s.stdout.ReadString('\n')
+	if err != nil && message == "" {
+		return fmt.Errorf("unexpected response: %d", code)
+	}
+
+	return errors.New(strings.TrimSpace(message))
+}
+
+// writeAck acknowledges the last protocol message.
+func (s *scpSession) writeAck() error {
+	_, err := s.stdin.Write([]byte{0})
+	return err
+}
+
+// copyTo uploads a local file to a remote path.
+func copyTo(client *ssh.Client, local string, remote string) (int64, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Preserving the mode requires the remote scp program to also apply it to existing files.
+	mode := os.FileMode(scpFileMode)
+	arguments := "-t -- " + shellQuote(remote)
+	if getBool("PRESERVE_MODE") {
+		mode = info.Mode().Perm()
+		arguments = "-p " + arguments
+	} else if modes, _ := getFileModes(); modes.single() {
+		mode = modes.Default
+		arguments = "-p " + arguments
+	}
+
+	s, err := startSCP(client, arguments)
+	if err != nil {
+		return 0, err
+	}
+	defer s.close()
+
+	if err := s.readAck(); err != nil {
+		return 0, s.fail(err)
+	}
+
+	// A time record has the format "T<mtime> 0 <atime> 0" and precedes the copy record.
+	if getBool("PRESERVE_TIMES") {
+		if _, err := fmt.Fprintf(s.stdin, "T%d 0 %d 0\n", info.ModTime().Unix(), accessTime(info).Unix()); err != nil {
+			return 0, s.fail(err)
+		}
+		if err := s.readAck(); err != nil {
+			return 0, s.fail(err)
+		}
+	}
+
+	if _, err := fmt.Fprintf(s.stdin, "C%04o %d %s\n", mode, info.Size(), path.Base(remote)); err != nil {
+		return 0, s.fail(err)
+	}
+	if err := s.readAck(); err != nil {
+		return 0, s.fail(err)
+	}
+
+	n, err := streamFile(local, info.Size(), s.stdin, file)
+	if err != nil {
+		return n, s.fail(err)
+	}
+	if n != info.Size() {
+		return n, fmt.Errorf("file changed during transfer: expected %d bytes, read %d", info.Size(), n)
+	}
+
+	if err := s.writeAck(); err != nil {
+		return n, s.fail(err)
+	}
+	if err := s.readAck(); err != nil {
+		return n, s.fail(err)
+	}
+
+	return n, nil
+}
+
+// copyFrom downloads a remote file to a local path.
+func copyFrom(client *ssh.Client, remote string, local string) (int64, error) {
+	preserveTimes := getBool("PRESERVE_TIMES")
+	arguments := "-f -- " + shellQuote(remote)
+	if preserveTimes {
+		arguments = "-p " + arguments
+	}
+
+	s, err := startSCP(client, arguments)
+	if err != nil {
+		return 0, err
+	}
+	defer s.close()
+
+	if err := s.writeAck(); err != nil {
+		return 0, s.fail(err)
+	}
+
+	code, line, err := s.readRecord()
+	if err != nil {
+		return 0, s.fail(err)
+	}
+
+	var modified, accessed time.Time
+	if code == 'T' {
+		if modified, accessed, err = parseTimeRecord(line); err != nil {
+			return 0, err
+		}
+		if err := s.writeAck(); err != nil {
+			return 0, s.fail(err)
+		}
+		if code, line, err = s.readRecord(); err != nil {
+			return 0, s.fail(err)
+		}
+	}
+
+	if code != 'C' {
+		return 0, s.fail(errors.New(strings.TrimSpace(line)))
+	}
+
+	_, size, err := parseCopyRecord(line)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.writeAck(); err != nil {
+		return 0, s.fail(err)
+	}
+
+	file, err := os.Create(local)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := streamFile(remote, size, file, s.stdout)
+	if err != nil {
+		return n, s.fail(err)
+	}
+	if n != size {
+		return n, s.fail(fmt.Errorf("unexpected end of file: expected %d bytes, received %d", size, n))
+	}
+
+	if err := s.readAck(); err != nil {
+		return n, s.fail(err)
+	}
+	if err := s.writeAck(); err != nil {
+		return n, s.fail(err)
+	}
+
+	if err := file.Close(); err != nil {
+		return n, err
+	}
+
+	if preserveTimes && !modified.IsZero() {
+		if err := os.Chtimes(local, accessed, modified); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// copyRelay streams a file from a remote path on the source host to a remote path on the
+// target host, like "scp -3", without storing it on the local machine.
+func copyRelay(source *ssh.Client, target *ssh.Client, sourcePath string, targetPath string) (int64, error) {
+	preserve := ""
+	if getBool("PRESERVE_TIMES") || getBool("PRESERVE_MODE") {
+		preserve = "-p "
+	}
+
+	from, err := startSCP(source, preserve+"-f -- "+shellQuote(sourcePath))
+	if err != nil {
+		return 0, err
+	}
+	defer from.close()
+
+	to, err := startSCP(target, preserve+"-t -- "+shellQuote(targetPath))
+	if err != nil {
+		return 0, err
+	}
+	defer to.close()
+
+	if err := to.readAck(); err != nil {
+		return 0, to.fail(err)
+	}
+	if err := from.writeAck(); err != nil {
+		return 0, from.fail(err)
+	}
+
+	code, line, err := from.readRecord()
+	if err != nil {
+		return 0, from.fail(err)
+	}
+
+	// Forward the time record, which is only sent if times are preserved.
+	if code == 'T' {
+		if _, err := fmt.Fprintf(to.stdin, "T%s", line); err != nil {
+			return 0, to.fail(err)
+		}
+		if err := to.readAck(); err != nil {
+			return 0, to.fail(err)
+		}
+		if err := from.writeAck(); err != nil {
+			return 0, from.fail(err)
+		}
+		if code, line, err = from.readRecord(); err != nil {
+			return 0, from.fail(err)
+		}
+	}
+
+	if code != 'C' {
+		return 0, from.fail(errors.New(strings.TrimSpace(line)))
+	}
+
+	mode, size, err := parseCopyRecord(line)
+	if err != nil {
+		return 0, err
+	}
+	if preserve == "" || !getBool("PRESERVE_MODE") {
+		mode = scpFileMode
+	}
+
+	if _, err := fmt.Fprintf(to.stdin, "C%04o %d %s\n", mode, size, path.Base(targetPath)); err != nil {
+		return 0, to.fail(err)
+	}
+	if err := to.readAck(); err != nil {
+		return 0, to.fail(err)
+	}
+	if err := from.writeAck(); err != nil {
+		return 0, from.fail(err)
+	}
+
+	n, err := streamFile(sourcePath, size, to.stdin, from.stdout)
+	if err != nil {
+		return n, to.fail(err)
+	}
+	if n != size {
+		return n, from.fail(fmt.Errorf("unexpected end of file: expected %d bytes, received %d", size, n))
+	}
+
+	if err := from.readAck(); err != nil {
+		return n, from.fail(err)
+	}
+	if err := from.writeAck(); err != nil {
+		return n, from.fail(err)
+	}
+	if err := to.writeAck(); err != nil {
+		return n, to.fail(err)
+	}
+	if err := to.readAck(); err != nil {
+		return n, to.fail(err)
+	}
+
+	return n, nil
+}
+
+// readRecord reads a protocol record and returns its type and the remainder of the line.
+func (s *scpSession) readRecord() (byte, string, error) {
+	code, err := s.stdout.ReadByte()
+	if err != nil {
+		return 0, "", err
+	}
+
+	line, err := s.stdout.ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+
+	return code, line, nil
+}
+
+// parseCopyRecord parses the remainder of a copy record, which has the format "<mode> <size> <name>".
+func parseCopyRecord(line string) (os.FileMode, int64, error) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, fmt.Errorf("invalid copy record: %q", line)
+	}
+
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid file mode in copy record: %q", line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid file size in copy record: %q", line)
+	}
+
+	return os.FileMode(mode), size, nil
+}
+
+// parseTimeRecord parses the remainder of a time record, which has the format "<mtime> 0 <atime> 0".
+func parseTimeRecord(line string) (time.Time, time.Time, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid time record: %q", line)
+	}
+
+	modified, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid time record: %q", line)
+	}
+	accessed, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid time record: %q", line)
+	}
+
+	return time.Unix(modified, 0), time.Unix(accessed, 0), nil
+}
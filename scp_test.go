@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// streamSize is the size of the generated file, far more than the allocation that is allowed
+// for streaming it.
+const streamSize = 4 << 30
+
+// generatedReader yields an endless stream without touching the buffer, so that the test
+// measures the copy rather than the generation of the content.
+type generatedReader struct{}
+
+func (generatedReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// countingWriter counts the written bytes without storing them. Unlike ioutil.Discard, it does
+// not read from the reader with a buffer of its own.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestStreamFileAllocationIsBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams several gigabytes")
+	}
+	unsetEnv(t, "MAX_RATE", "PROGRESS_INTERVAL", "QUIET")
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	w := &countingWriter{}
+	n, err := streamFile("generated", streamSize, w, generatedReader{})
+
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != streamSize || w.n != streamSize {
+		t.Fatalf("streamed %d bytes and wrote %d, expected %d", n, w.n, streamSize)
+	}
+
+	// Besides the buffer, only the progress tracking allocates a little.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2*scpBufferSize {
+		t.Errorf("allocated %d bytes to stream %d bytes, expected at most %d", allocated, streamSize, 2*scpBufferSize)
+	}
+}
+
+func BenchmarkStreamFile(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(streamSize)
+	for i := 0; i < b.N; i++ {
+		if _, err := streamFile("generated", streamSize, &countingWriter{}, io.LimitReader(generatedReader{}, streamSize)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUploadPreservesMode(t *testing.T) {
+	client := startTestServer(t)
+	unsetEnv(t, "PRESERVE_MODE", "MODE", "CHMOD", "FLATTEN", "EXCLUDE", "INCLUDE_HIDDEN", "STRIP_COMPONENTS")
+	os.Setenv("PRESERVE_MODE", "true")
+
+	local := filepath.Join(t.TempDir(), "deploy")
+	if err := os.MkdirAll(filepath.Join(local, "bin"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, "bin", "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The permissions are set explicitly, since the umask may have removed some of them.
+	for name, mode := range map[string]os.FileMode{"bin": 0750, "bin/run.sh": 0755} {
+		if err := os.Chmod(filepath.Join(local, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remote := filepath.Join(t.TempDir(), "www")
+	transfers, err := newPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PlanUpload(transfers, sourceGroup{Sources: []string{local}, Target: remote + "/"}, remoteSide{client}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateRemoteDirectories(client, transfers.Directories); err != nil {
+		t.Fatal(err)
+	}
+	for _, transfer := range transfers.Transfers {
+		if _, err := copyTo(client, transfer.Source, transfer.Target); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, mode := range map[string]os.FileMode{"bin": 0750, "bin/run.sh": 0755} {
+		info, err := os.Stat(filepath.Join(remote, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("mode of %s is %04o, expected %04o", name, info.Mode().Perm(), mode)
+		}
+	}
+}
+
+func TestPreserveTimesRoundTrip(t *testing.T) {
+	client := startTestServer(t)
+	unsetEnv(t, "PRESERVE_TIMES", "PRESERVE_MODE", "MODE", "CHMOD")
+	os.Setenv("PRESERVE_TIMES", "true")
+
+	dir := t.TempDir()
+	local := filepath.Join(dir, "source.txt")
+	if err := ioutil.WriteFile(local, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	accessed := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(local, accessed, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote file is checked before the download, which updates its access time.
+	remote := filepath.Join(dir, "remote.txt")
+	if _, err := copyTo(client, local, remote); err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, remote, modified, accessed)
+
+	downloaded := filepath.Join(dir, "downloaded.txt")
+	if _, err := copyFrom(client, remote, downloaded); err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, downloaded, modified, accessed)
+}
+
+// checkTimes verifies the modification and access time of a file.
+func checkTimes(t *testing.T, name string, modified time.Time, accessed time.Time) {
+	t.Helper()
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modified) {
+		t.Errorf("modification time of %s is %v, expected %v", filepath.Base(name), info.ModTime().UTC(), modified)
+	}
+	// Access times are only read on Linux.
+	if runtime.GOOS == "linux" && !accessTime(info).Equal(accessed) {
+		t.Errorf("access time of %s is %v, expected %v", filepath.Base(name), accessTime(info).UTC(), accessed)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ProtocolSCP transfers files with the remote scp program.
+	ProtocolSCP = "scp"
+	// ProtocolSFTP transfers files over the SFTP subsystem of the remote host.
+	ProtocolSFTP = "sftp"
+	// ProtocolAuto transfers files with the remote scp program, falling back to SFTP if the
+	// remote host has no scp program.
+	ProtocolAuto = "auto"
+)
+
+// getProtocol parses the protocol used to transfer files, which defaults to scp.
+func getProtocol() (string, error) {
+	switch protocol := strings.ToLower(strings.TrimSpace(os.Getenv("PROTOCOL"))); protocol {
+	case "", ProtocolSCP:
+		return ProtocolSCP, nil
+	case ProtocolSFTP, ProtocolAuto:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("invalid protocol: %s", protocol)
+	}
+}
+
+var (
+	// sftpClients holds an SFTP session for each connection, which is shared by concurrent
+	// transfers over the connection.
+	sftpClients   = map[*ssh.Client]*sftp.Client{}
+	sftpClientsMu sync.Mutex
+)
+
+// sftpClient returns the SFTP session of a connection, starting it on first use.
+func sftpClient(client *ssh.Client) (*sftp.Client, error) {
+	sftpClientsMu.Lock()
+	defer sftpClientsMu.Unlock()
+
+	if c, ok := sftpClients[client]; ok {
+		return c, nil
+	}
+
+	c, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start sftp subsystem: %v", err)
+	}
+	sftpClients[client] = c
+
+	return c, nil
+}
+
+// CheckRemoteSFTP verifies that the SFTP subsystem is available on the remote host.
+func CheckRemoteSFTP(client *ssh.Client) error {
+	_, err := sftpClient(client)
+	return err
+}
+
+// sftpCopyTo uploads a local file to a remote path over SFTP.
+func sftpCopyTo(client *ssh.Client, local string, remote string) (int64, error) {
+	c, err := sftpClient(client)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Like the remote scp program, create the file inside the target if it is a directory.
+	if stat, err := c.Stat(remote); err == nil && stat.IsDir() {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+
+	target, err := c.OpenFile(remote, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, err
+	}
+	defer target.Close()
+
+	n, err := streamFile(local, info.Size(), target, file)
+	if err != nil {
+		return n, err
+	}
+	if n != info.Size() {
+		return n, fmt.Errorf("file changed during transfer: expected %d bytes, read %d", info.Size(), n)
+	}
+	if err := target.Close(); err != nil {
+		return n, err
+	}
+
+	if getBool("PRESERVE_MODE") {
+		if err := c.Chmod(remote, info.Mode().Perm()); err != nil {
+			return n, err
+		}
+	}
+	if getBool("PRESERVE_TIMES") {
+		if err := c.Chtimes(remote, accessTime(info), info.ModTime()); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// sftpCopyFrom downloads a remote file to a local path over SFTP.
+func sftpCopyFrom(client *ssh.Client, remote string, local string) (int64, error) {
+	c, err := sftpClient(client)
+	if err != nil {
+		return 0, err
+	}
+
+	source, err := c.Open(remote)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("%s is not a regular file", remote)
+	}
+
+	file, err := os.Create(local)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := streamFile(remote, info.Size(), file, source)
+	if err != nil {
+		return n, err
+	}
+	if n != info.Size() {
+		return n, fmt.Errorf("unexpected end of file: expected %d bytes, received %d", info.Size(), n)
+	}
+	if err := file.Close(); err != nil {
+		return n, err
+	}
+
+	if getBool("PRESERVE_TIMES") {
+		accessed := info.ModTime()
+		if stat, ok := info.Sys().(*sftp.FileStat); ok {
+			accessed = time.Unix(int64(stat.Atime), 0)
+		}
+		if err := os.Chtimes(local, accessed, info.ModTime()); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// fallback transfers files with the remote scp program until it turns out to be missing, and
+// over SFTP from then on, including the file that failed.
+type fallback struct {
+	scp  copyFunc
+	sftp copyFunc
+
+	mu       sync.Mutex
+	switched bool
+}
+
+// useSFTP switches to SFTP, logging the reason only once.
+func (f *fallback) useSFTP(reason error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.switched {
+		log.Printf("⚠️ Remote scp program not found, falling back to sftp: %v", reason)
+		f.switched = true
+	}
+}
+
+// usingSFTP reports whether the files are transferred over SFTP.
+func (f *fallback) usingSFTP() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.switched
+}
+
+// check verifies that either a configured remote scp program or the SFTP subsystem is available.
+func (f *fallback) check(client *ssh.Client) error {
+	if err := CheckRemoteSCP(client); err != nil {
+		f.useSFTP(err)
+		return CheckRemoteSFTP(client)
+	}
+	return nil
+}
+
+func (f *fallback) copy(client *ssh.Client, source string, target string) (int64, error) {
+	if f.usingSFTP() {
+		return f.sftp(client, source, target)
+	}
+
+	n, err := f.scp(client, source, target)
+	if err == nil || !isSCPMissing(err) {
+		return n, err
+	}
+
+	f.useSFTP(err)
+	return f.sftp(client, source, target)
+}
+
+// isSCPMissing reports whether an error of the remote scp program indicates that the shell of
+// the remote host could not find it.
+func isSCPMissing(err error) bool {
+	message := strings.ToLower(err.Error())
+	if strings.Contains(message, "status 127") {
+		return true
+	}
+
+	for _, program := range []string{"scp", strings.ToLower(os.Getenv("REMOTE_SCP_PATH"))} {
+		for _, missing := range []string{": not found", ": command not found", ": no such file or directory"} {
+			if program != "" && strings.Contains(message, program+missing) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// exitCancelled is the exit code of a run that was cancelled by a signal, like a shell uses for
+// a process interrupted by SIGINT.
+const exitCancelled = 130
+
+// errCancelled is returned by work that was stopped because the action is being cancelled.
+var errCancelled = errors.New("cancelled")
+
+var (
+	// cancelling is set once a signal was received.
+	cancelling int32
+	// cancelFuncs are run in reverse order when the action is cancelled.
+	cancelFuncs   []func()
+	cancelFuncsMu sync.Mutex
+)
+
+// OnCancel registers a function that is run when the action is cancelled, e.g. to report the
+// progress so far or to close a connection.
+func OnCancel(fn func()) {
+	cancelFuncsMu.Lock()
+	defer cancelFuncsMu.Unlock()
+	cancelFuncs = append(cancelFuncs, fn)
+}
+
+// HandleSignals cancels the action cleanly on SIGINT or SIGTERM, which a CI system sends when a
+// job is cancelled. The registered functions are run, most recent first, before the action exits.
+func HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		atomic.StoreInt32(&cancelling, 1)
+		log.Printf("🛑 Received %v, cancelling", sig)
+
+		cancelFuncsMu.Lock()
+		for i := len(cancelFuncs) - 1; i >= 0; i-- {
+			cancelFuncs[i]()
+		}
+		os.Exit(exitCancelled)
+	}()
+}
+
+// Cancelling reports whether the action is being cancelled, in which case it exits as soon as
+// the registered functions have run.
+func Cancelling() bool {
+	return atomic.LoadInt32(&cancelling) == 1
+}
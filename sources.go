@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultMappingSeparator separates a source from its target in a line of the source list.
+const defaultMappingSeparator = "=>"
+
+// sourceGroup is a list of sources that are copied to the same target.
+type sourceGroup struct {
+	Sources []string
+	Target  string
+	// Folder forces the target to be treated as a folder, even for a single source file.
+	Folder bool
+}
+
+// ReadManifest reads a local file listing sources, one per line in the format of the source
+// list, e.g. as generated by a previous step.
+func ReadManifest(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n"), nil
+}
+
+// SplitSources splits the source input into lines. Besides newlines, lines are separated by the
+// delimiter, which is detected as a comma if the input is a single line containing commas. A
+// newline delimiter disables splitting on anything else. An escaped delimiter, e.g. "\,", is
+// part of the line.
+func SplitSources(value string, delimiter string) []string {
+	switch delimiter {
+	case "":
+		if !strings.Contains(value, "\n") && strings.Contains(value, ",") {
+			delimiter = ","
+		}
+	case `\n`, "\n", "newline":
+		delimiter = ""
+	}
+	if delimiter == "" {
+		return strings.Split(value, "\n")
+	}
+
+	var lines []string
+	var line strings.Builder
+	for i := 0; i < len(value); {
+		switch {
+		case strings.HasPrefix(value[i:], `\`+delimiter):
+			line.WriteString(delimiter)
+			i += len(delimiter) + 1
+		case strings.HasPrefix(value[i:], delimiter) || value[i] == '\n':
+			lines = append(lines, line.String())
+			line.Reset()
+			if value[i] == '\n' {
+				i++
+			} else {
+				i += len(delimiter)
+			}
+		default:
+			line.WriteByte(value[i])
+			i++
+		}
+	}
+	return append(lines, line.String())
+}
+
+// ParseSources splits the source list into groups of sources sharing a target. Lines of
+// the form "source => folder/" are copied into the given folder, lines of the form
+// "source => target" behave as if the target was given for this source alone, while all
+// other lines are copied to the default target. Lines are trimmed including carriage returns,
+// blank lines as well as comments starting with "#" are ignored, and repeated sources of a
+// target are only copied once.
+func ParseSources(lines []string, defaultTarget string, separator string) ([]sourceGroup, error) {
+	if separator == "" {
+		separator = defaultMappingSeparator
+	}
+
+	// Like mapped targets, a default target with a trailing slash is always a folder.
+	defaultGroup := sourceGroup{Target: defaultTarget, Folder: strings.HasSuffix(defaultTarget, "/") || strings.HasSuffix(defaultTarget, `\`)}
+	var mapped []*sourceGroup
+	byTarget := map[string]*sourceGroup{}
+	seen := map[string]bool{}
+
+	for i, line := range lines {
+		if line = strings.TrimSpace(line); ignoreLine(line) {
+			continue
+		}
+
+		index := strings.Index(line, separator)
+		if index < 0 {
+			if !repeatedSource(seen, line, defaultTarget) {
+				defaultGroup.Sources = append(defaultGroup.Sources, line)
+			}
+			continue
+		}
+
+		source := strings.TrimSpace(line[:index])
+		target := strings.TrimSpace(line[index+len(separator):])
+		if source == "" || target == "" || strings.Contains(target, separator) {
+			return nil, fmt.Errorf("line %d: expected \"source %s target\", got %q", i+1, separator, line)
+		}
+		if repeatedSource(seen, source, target) {
+			continue
+		}
+
+		// Without a trailing slash, the target is the exact path of a single source file.
+		if !strings.HasSuffix(target, "/") && !strings.HasSuffix(target, `\`) {
+			mapped = append(mapped, &sourceGroup{Sources: []string{source}, Target: target})
+			continue
+		}
+
+		group, ok := byTarget[target]
+		if !ok {
+			group = &sourceGroup{Target: target, Folder: true}
+			byTarget[target] = group
+			mapped = append(mapped, group)
+		}
+		group.Sources = append(group.Sources, source)
+	}
+
+	var groups []sourceGroup
+	if len(defaultGroup.Sources) > 0 {
+		groups = append(groups, defaultGroup)
+	}
+	for _, group := range mapped {
+		groups = append(groups, *group)
+	}
+
+	return groups, nil
+}
+
+// PairSources maps every source to the target on the same position, so that each source is
+// copied as if the target was given for this source alone. Blank lines and comments are ignored,
+// and repeated pairs are only copied once.
+func PairSources(lines []string, targets []string) ([]sourceGroup, error) {
+	var sources []string
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); !ignoreLine(line) {
+			sources = append(sources, line)
+		}
+	}
+
+	if len(sources) != len(targets) {
+		return nil, fmt.Errorf("source has %d entries, but target has %d entries", len(sources), len(targets))
+	}
+
+	var groups []sourceGroup
+	seen := map[string]bool{}
+	for i, source := range sources {
+		target := targets[i]
+		if repeatedSource(seen, source, target) {
+			continue
+		}
+		groups = append(groups, sourceGroup{
+			Sources: []string{source},
+			Target:  target,
+			Folder:  strings.HasSuffix(target, "/") || strings.HasSuffix(target, `\`),
+		})
+	}
+
+	return groups, nil
+}
+
+// ResolveWorkingDir prepends the working directory to the relative local paths of the groups,
+// which are the sources of an upload and the targets of a download.
+func ResolveWorkingDir(groups []sourceGroup, dir string, direction string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	for i := range groups {
+		if direction == DirectionDownload {
+			groups[i].Target = joinLocal(dir, groups[i].Target)
+			continue
+		}
+		if direction == DirectionUpload {
+			for j, source := range groups[i].Sources {
+				groups[i].Sources[j] = joinLocal(dir, source)
+			}
+		}
+	}
+
+	return nil
+}
+
+// joinLocal prepends a directory to a relative local path, keeping a trailing separator.
+func joinLocal(dir string, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	joined := filepath.Join(dir, name)
+	if strings.HasSuffix(name, "/") || strings.HasSuffix(name, `\`) {
+		joined += string(filepath.Separator)
+	}
+	return joined
+}
+
+// ignoreLine reports whether a trimmed line of the source list is blank or a comment.
+func ignoreLine(line string) bool {
+	return line == "" || strings.HasPrefix(line, "#")
+}
+
+// repeatedSource reports whether a source was already given for the same target, and records it
+// otherwise.
+func repeatedSource(seen map[string]bool, source string, target string) bool {
+	key := source + "\x00" + target
+	if seen[key] {
+		debugf("Ignoring repeated source %s for target %s", source, target)
+		return true
+	}
+	seen[key] = true
+	return false
+}
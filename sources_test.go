@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSourcesMappings(t *testing.T) {
+	lines := []string{
+		"dist/my app.zip",
+		"config/nginx.conf => /etc/nginx/nginx.conf\r",
+		"  deploy/app.service   =>   /etc/systemd/system/app.service  ",
+		"assets/My Logo.png => /var/www/static files/",
+		"assets/icon 32.png => /var/www/static files/",
+	}
+
+	groups, err := ParseSources(lines, "/srv/app/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []sourceGroup{
+		{Sources: []string{"dist/my app.zip"}, Target: "/srv/app/", Folder: true},
+		{Sources: []string{"config/nginx.conf"}, Target: "/etc/nginx/nginx.conf"},
+		{Sources: []string{"deploy/app.service"}, Target: "/etc/systemd/system/app.service"},
+		{Sources: []string{"assets/My Logo.png", "assets/icon 32.png"}, Target: "/var/www/static files/", Folder: true},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("ParseSources returned %+v, expected %+v", groups, expected)
+	}
+}
+
+func TestParseSourcesCustomSeparator(t *testing.T) {
+	groups, err := ParseSources([]string{"a=>b.txt -> /tmp/a=>b.txt"}, ".", "->")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []sourceGroup{{Sources: []string{"a=>b.txt"}, Target: "/tmp/a=>b.txt"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("ParseSources returned %+v, expected %+v", groups, expected)
+	}
+}
+
+func TestParseSourcesMalformedLines(t *testing.T) {
+	tests := []struct {
+		lines []string
+		line  string
+	}{
+		{[]string{"a.txt", "=> /etc/a.txt"}, "line 2:"},
+		{[]string{"a.txt =>"}, "line 1:"},
+		{[]string{"", "# comment", "a.txt => b => c"}, "line 3:"},
+		{[]string{"a.txt", "b.txt\r", " => \r"}, "line 3:"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseSources(test.lines, ".", "")
+		if err == nil || !strings.HasPrefix(err.Error(), test.line) {
+			t.Errorf("ParseSources(%q) returned %v, expected an error starting with %q", test.lines, err, test.line)
+		}
+	}
+}
+
+func TestParseSourcesMessyInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{"crlf", "dist/app.js\r\ndist/app.css\r\n", []string{"dist/app.js", "dist/app.css"}},
+		{"trailing blank lines", "dist/app.js\n\n\n", []string{"dist/app.js"}},
+		{"blank lines between", "a.txt\n  \n\t\nb.txt", []string{"a.txt", "b.txt"}},
+		{"surrounding whitespace", "  a.txt \t\n\tb.txt\r ", []string{"a.txt", "b.txt"}},
+		{"repeated", "a.txt\nb.txt\na.txt\r\n a.txt", []string{"a.txt", "b.txt"}},
+		{"comments", "# build output\na.txt\n  # docs\r\n", []string{"a.txt"}},
+		{"commas", "a.txt, b.txt ,c.txt", []string{"a.txt", "b.txt", "c.txt"}},
+		{"empty", "", nil},
+		{"only whitespace", " \r\n\t\r\n\n", nil},
+	}
+
+	for _, test := range tests {
+		groups, err := ParseSources(SplitSources(test.value, ""), ".", "")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		var sources []string
+		for _, group := range groups {
+			sources = append(sources, group.Sources...)
+		}
+		if !reflect.DeepEqual(sources, test.expected) {
+			t.Errorf("%s: parsed %q, expected %q", test.name, sources, test.expected)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshOption applies an OpenSSH client option to the configuration of a connection.
+type sshOption func(config *ssh.ClientConfig, c *connector)
+
+// getSSHOptions parses the OpenSSH client options in EXTRA_SSH_OPTIONS, one "Key=Value" or
+// "Key Value" pair per line. Options are matched case-insensitively like in ssh_config, and
+// options without an equivalent in the ssh client of the action are ignored with a warning.
+func getSSHOptions() ([]sshOption, error) {
+	var options []sshOption
+	for _, line := range getList("EXTRA_SSH_OPTIONS") {
+		key, value := line, ""
+		if i := strings.IndexAny(line, "= \t"); i >= 0 {
+			key, value = line[:i], strings.TrimSpace(strings.TrimLeft(line[i:], "= \t"))
+		}
+		if value == "" {
+			return nil, fmt.Errorf("missing value of option %s", key)
+		}
+
+		option, err := parseSSHOption(strings.ToLower(key), value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of option %s: %v", key, err)
+		}
+		if option == nil {
+			log.Printf("⚠️ Ignoring unsupported ssh option %s", key)
+			continue
+		}
+		options = append(options, option)
+	}
+
+	return options, nil
+}
+
+// parseSSHOption parses the value of an option, returning nil if the option is not supported.
+func parseSSHOption(key string, value string) (sshOption, error) {
+	switch key {
+	case "ciphers":
+		list := splitAlgorithms(value)
+		return func(config *ssh.ClientConfig, c *connector) { config.Ciphers = list }, nil
+	case "kexalgorithms":
+		list := splitAlgorithms(value)
+		return func(config *ssh.ClientConfig, c *connector) { config.KeyExchanges = list }, nil
+	case "macs":
+		list := splitAlgorithms(value)
+		return func(config *ssh.ClientConfig, c *connector) { config.MACs = list }, nil
+	case "hostkeyalgorithms":
+		list := splitAlgorithms(value)
+		return func(config *ssh.ClientConfig, c *connector) { config.HostKeyAlgorithms = list }, nil
+	case "rekeylimit":
+		// Only the amount of data is supported, a time limit after it is ignored.
+		amount := strings.Fields(value)[0]
+		if strings.ToLower(amount) == "default" {
+			return func(config *ssh.ClientConfig, c *connector) {}, nil
+		}
+		limit, err := parseSSHSize(amount)
+		if err != nil {
+			return nil, err
+		}
+		return func(config *ssh.ClientConfig, c *connector) { config.RekeyThreshold = limit }, nil
+	case "serveraliveinterval":
+		interval, err := parseSSHSeconds(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(config *ssh.ClientConfig, c *connector) { c.KeepAliveInterval = interval }, nil
+	case "connecttimeout":
+		timeout, err := parseSSHSeconds(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(config *ssh.ClientConfig, c *connector) { c.DialTimeout = timeout }, nil
+	case "connectionattempts":
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return nil, errors.New("number of attempts must be a positive integer")
+		}
+		return func(config *ssh.ClientConfig, c *connector) { c.Retries = attempts - 1 }, nil
+	}
+
+	return nil, nil
+}
+
+// splitAlgorithms splits a comma-separated list of algorithms.
+func splitAlgorithms(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseSSHSeconds parses a number of seconds, where zero disables the setting like in ssh_config.
+func parseSSHSeconds(value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("number of seconds must be a non-negative integer")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// parseSSHSize parses a number of bytes with an optional K, M or G suffix like in ssh_config.
+func parseSSHSize(value string) (uint64, error) {
+	multiplier := uint64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("size must be a number of bytes, optionally followed by K, M or G")
+	}
+	return size * multiplier, nil
+}
+
+// applySSHOptions applies the options to the configuration of a connection.
+func applySSHOptions(options []sshOption, config *ssh.ClientConfig, c *connector) {
+	for _, option := range options {
+		option(config, c)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the last access time of a file. On this platform
+// it is not available, so the modification time is used instead.
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// fileOwner returns the user and group ID of the owner of a file,
+// which is not available on this platform.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
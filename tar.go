@@ -0,0 +1,438 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TransferModeSCP copies every file with a separate run of the remote scp program.
+	TransferModeSCP = "scp"
+	// TransferModeTar streams all files as a single tar archive to or from the remote tar program.
+	TransferModeTar = "tar"
+)
+
+// getTransferMode parses the transfer mode, which defaults to scp, or to tar in archive mode.
+func getTransferMode() (string, error) {
+	archive := getBool("ARCHIVE_MODE")
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("TRANSFER_MODE"))); mode {
+	case "":
+		if archive {
+			return TransferModeTar, nil
+		}
+		return TransferModeSCP, nil
+	case TransferModeSCP:
+		if archive {
+			return "", errors.New("archive mode requires transfer mode tar")
+		}
+		return TransferModeSCP, nil
+	case TransferModeTar:
+		return TransferModeTar, nil
+	default:
+		return "", fmt.Errorf("invalid transfer mode: %s", mode)
+	}
+}
+
+// tarEntry is a file that was written to or read from a tar stream.
+type tarEntry struct {
+	transfer transfer
+	bytes    int64
+	elapsed  time.Duration
+}
+
+// tarCommand returns the quoted name or path of the remote tar program.
+func tarCommand() string {
+	if program := os.Getenv("TAR_EXEC"); program != "" {
+		return shellQuote(program)
+	}
+	return "tar"
+}
+
+// CheckRemoteTar verifies that the remote tar program can be found on the remote host.
+func CheckRemoteTar(client *ssh.Client) error {
+	program := getString("TAR_EXEC", "tar")
+	if _, err := RunCommand(client, "command -v "+shellQuote(program)); err != nil {
+		return fmt.Errorf("tar not found at %s", program)
+	}
+	return nil
+}
+
+// tarScript returns the remote command that runs the tar program with the given arguments on
+// the archive streamed over the session. If TAR_TMP_PATH is set, the archive is stored in a
+// temporary file in that directory instead, for tar programs that cannot stream it.
+func tarScript(arguments string, extract bool) string {
+	dir := os.Getenv("TAR_TMP_PATH")
+	if dir == "" {
+		return tarCommand() + " " + arguments + " -f -"
+	}
+
+	archive := shellQuote(path.Join(dir, fmt.Sprintf("scp-action-%d.tar", time.Now().UnixNano())))
+	command := tarCommand() + " " + arguments + " -f " + archive
+	if extract {
+		return fmt.Sprintf("cat > %s && %s; status=$?; rm -f %s; exit $status", archive, command, archive)
+	}
+	return fmt.Sprintf("%s && cat %s; status=$?; rm -f %s; exit $status", command, archive, archive)
+}
+
+// startTar starts the remote tar program with the given arguments. The paths of the entries
+// are used as they are, so that absolute targets and targets relative to the home directory
+// are handled alike.
+func startTar(client *ssh.Client, arguments string, extract bool) (*ssh.Session, io.WriteCloser, io.Reader, *syncBuffer, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	stderr := &syncBuffer{}
+	session.Stderr = stderr
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	if err := session.Start(tarScript(arguments, extract)); err != nil {
+		session.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	return session, stdin, stdout, stderr, nil
+}
+
+// tarError extends an error with the messages of the remote tar program.
+func tarError(err error, stderr *syncBuffer) error {
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		return fmt.Errorf("%v: %s", err, message)
+	}
+	return err
+}
+
+// uploadTar streams the local files as a tar archive to the remote tar program, which extracts
+// them to their targets. The files are only reported as transferred once the remote tar
+// program has extracted all of them.
+func uploadTar(client *ssh.Client, transfers []transfer) ([]tarEntry, error) {
+	arguments := "-x -P --no-same-owner"
+	if !getBool("PRESERVE_TIMES") {
+		arguments = "-m " + arguments
+	}
+
+	session, stdin, _, stderr, err := startTar(client, arguments, true)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	entries := make([]tarEntry, 0, len(transfers))
+	writer := tar.NewWriter(stdin)
+	for _, t := range transfers {
+		start := time.Now()
+		n, err := writeTarFile(writer, t)
+		if err != nil {
+			stdin.Close()
+			session.Wait()
+			return nil, tarError(fmt.Errorf("failed to write %s: %v", t.Source, err), stderr)
+		}
+		entries = append(entries, tarEntry{transfer: t, bytes: n, elapsed: time.Since(start)})
+	}
+
+	if err := writer.Close(); err != nil {
+		stdin.Close()
+		session.Wait()
+		return nil, tarError(err, stderr)
+	}
+	stdin.Close()
+
+	if err := session.Wait(); err != nil {
+		return nil, tarError(fmt.Errorf("failed to extract archive: %v", err), stderr)
+	}
+
+	return entries, nil
+}
+
+// uploadArchive writes the local files to a local tar archive, uploads it with the remote scp
+// program to a temporary remote file and extracts it there, for hosts that cannot take the
+// archive as a stream. The remote archive is removed afterwards.
+func uploadArchive(client *ssh.Client, transfers []transfer) ([]tarEntry, error) {
+	archive, err := ioutil.TempFile("", "scp-action-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	entries := make([]tarEntry, 0, len(transfers))
+	writer := tar.NewWriter(archive)
+	for _, t := range transfers {
+		start := time.Now()
+		n, err := writeTarFile(writer, t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", t.Source, err)
+		}
+		entries = append(entries, tarEntry{transfer: t, bytes: n, elapsed: time.Since(start)})
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	remote := path.Join(getString("TAR_TMP_PATH", "/tmp"), path.Base(archive.Name()))
+	defer removeRemote(client, remote)
+	if _, err := copyTo(client, archive.Name(), remote); err != nil {
+		return nil, fmt.Errorf("failed to upload archive: %v", err)
+	}
+
+	arguments := "-x -P --no-same-owner"
+	if !getBool("PRESERVE_TIMES") {
+		arguments = "-m " + arguments
+	}
+	if _, err := RunCommand(client, tarCommand()+" "+arguments+" -f "+shellQuote(remote)); err != nil {
+		return nil, fmt.Errorf("failed to extract archive: %v", err)
+	}
+
+	return entries, nil
+}
+
+// writeTarFile writes a local file as an entry named after its target.
+func writeTarFile(writer *tar.Writer, t transfer) (int64, error) {
+	if t.Link != "" {
+		return 0, writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     t.Target,
+			Linkname: t.Link,
+			Mode:     0777,
+			ModTime:  t.Info.ModTime(),
+			Format:   tar.FormatPAX,
+		})
+	}
+
+	file, err := os.Open(t.Source)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, errors.New("not a regular file")
+	}
+
+	mode := int64(scpFileMode)
+	if getBool("PRESERVE_MODE") {
+		mode = int64(info.Mode().Perm())
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     t.Target,
+		Mode:     mode,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Format:   tar.FormatPAX,
+	}
+	if err := writer.WriteHeader(header); err != nil {
+		return 0, err
+	}
+
+	n, err := streamFile(t.Source, info.Size(), writer, file)
+	if err != nil {
+		return n, err
+	}
+	if n != info.Size() {
+		return n, fmt.Errorf("file changed during transfer: expected %d bytes, read %d", info.Size(), n)
+	}
+
+	return n, nil
+}
+
+// downloadTar runs the remote tar program to archive the remote files and extracts the stream
+// to the local targets. The list of files is passed on the standard input, so that it is not
+// bound by the maximum length of a command.
+func downloadTar(client *ssh.Client, transfers []transfer) ([]tarEntry, error) {
+	// The remote tar program may strip the leading slash of absolute paths.
+	targets := make(map[string]transfer, len(transfers))
+	var list bytes.Buffer
+	for _, t := range transfers {
+		targets[strings.TrimPrefix(t.Source, "/")] = t
+		list.WriteString(t.Source)
+		list.WriteByte(0)
+	}
+
+	// Symlinks are archived as the files they refer to, like they are copied in the other
+	// transfer modes.
+	session, stdin, stdout, stderr, err := startTar(client, "-c -P -h --null -T -", false)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	if _, err := stdin.Write(list.Bytes()); err != nil {
+		return nil, tarError(err, stderr)
+	}
+	stdin.Close()
+
+	entries := make([]tarEntry, 0, len(transfers))
+	extracted := make(map[string]string, len(transfers))
+	reader := tar.NewReader(stdout)
+	for {
+		start := time.Now()
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			session.Wait()
+			return nil, tarError(fmt.Errorf("failed to read archive: %v", err), stderr)
+		}
+
+		// Only the requested files are extracted, which also guards against entries that
+		// would be written outside of the targets.
+		name := strings.TrimPrefix(header.Name, "/")
+		t, ok := targets[name]
+		if !ok {
+			continue
+		}
+
+		var n int64
+		switch header.Typeflag {
+		case tar.TypeReg:
+			n, err = readTarFile(reader, header.Size, header, t)
+		case tar.TypeLink:
+			// The files that share their content with a file archived before are archived as
+			// hardlinks to it, so they are extracted as copies of it.
+			original, ok := extracted[strings.TrimPrefix(header.Linkname, "/")]
+			if !ok {
+				continue
+			}
+			n, err = copyTarFile(original, header, t)
+		default:
+			continue
+		}
+		delete(targets, name)
+		extracted[name] = t.Target
+		if err != nil {
+			session.Wait()
+			return nil, tarError(fmt.Errorf("failed to extract %s: %v", t.Source, err), stderr)
+		}
+		entries = append(entries, tarEntry{transfer: t, bytes: n, elapsed: time.Since(start)})
+	}
+
+	if err := session.Wait(); err != nil {
+		return nil, tarError(fmt.Errorf("failed to create archive: %v", err), stderr)
+	}
+	if len(targets) > 0 {
+		return nil, fmt.Errorf("%d files missing from archive", len(targets))
+	}
+
+	return entries, nil
+}
+
+// readTarFile extracts the content of an entry of the archive to its local target.
+func readTarFile(reader io.Reader, size int64, header *tar.Header, t transfer) (int64, error) {
+	file, err := os.Create(t.Target)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := streamFile(t.Source, size, file, reader)
+	if err != nil {
+		return n, err
+	}
+	if n != size {
+		return n, fmt.Errorf("unexpected end of file: expected %d bytes, received %d", size, n)
+	}
+
+	if err := file.Close(); err != nil {
+		return n, err
+	}
+
+	if getBool("PRESERVE_MODE") {
+		if err := os.Chmod(t.Target, os.FileMode(header.Mode).Perm()); err != nil {
+			return n, err
+		}
+	}
+	if getBool("PRESERVE_TIMES") {
+		accessed := header.AccessTime
+		if accessed.IsZero() {
+			accessed = header.ModTime
+		}
+		if err := os.Chtimes(t.Target, accessed, header.ModTime); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// copyTarFile extracts a hardlink entry of the archive by copying the file that was extracted
+// for the entry it links to.
+func copyTarFile(original string, header *tar.Header, t transfer) (int64, error) {
+	file, err := os.Open(original)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return readTarFile(file, info.Size(), header, t)
+}
+
+// CopyTar copies all files as a single tar stream and records them in the report. Since the
+// archive is extracted as a whole, a failure fails all of its files.
+func CopyTar(client *ssh.Client, transfers []transfer, results *report, direction string) error {
+	if len(transfers) == 0 {
+		return nil
+	}
+
+	copy := uploadTar
+	if getBool("ARCHIVE_MODE") {
+		copy = uploadArchive
+	}
+	if direction == DirectionDownload {
+		copy = downloadTar
+	}
+
+	start := time.Now()
+	entries, err := copy(client, transfers)
+	if err != nil {
+		for _, t := range transfers {
+			results.Fail(t, time.Since(start), err)
+		}
+		return err
+	}
+
+	quiet := getBool("QUIET")
+	for _, entry := range entries {
+		results.Transfer(entry.transfer, entry.bytes, entry.elapsed)
+		if !quiet {
+			log.Printf("📑 %s >> %s (%s)", entry.transfer.Source, entry.transfer.Target, formatThroughput(entry.bytes, entry.elapsed))
+		}
+	}
+	log.Printf("📦 Transferred %d entries as tar archive in %s", len(entries), time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
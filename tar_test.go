@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadTarFollowsLinks(t *testing.T) {
+	client := startTestServer(t)
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+	unsetEnv(t, "PRESERVE_TIMES", "PRESERVE_MODE", "MODE", "CHMOD")
+
+	remote := t.TempDir()
+	data := filepath.Join(remote, "data.txt")
+	if err := ioutil.WriteFile(data, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("data.txt", filepath.Join(remote, "symlink.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(data, filepath.Join(remote, "hardlink.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hardlink follows the file it shares its content with, so that it is archived second.
+	local := t.TempDir()
+	var transfers []transfer
+	for _, name := range []string{"data.txt", "hardlink.txt", "symlink.txt"} {
+		transfers = append(transfers, transfer{Source: filepath.Join(remote, name), Target: filepath.Join(local, name)})
+	}
+
+	entries, err := downloadTar(client, transfers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(transfers) {
+		t.Errorf("extracted %d files, expected %d", len(entries), len(transfers))
+	}
+	for _, transfer := range transfers {
+		info, err := os.Lstat(transfer.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("%s is not a regular file", filepath.Base(transfer.Target))
+		}
+		content, err := ioutil.ReadFile(transfer.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := string(content); actual != "content" {
+			t.Errorf("content of %s is %q, expected %q", filepath.Base(transfer.Target), actual, "content")
+		}
+	}
+}
@@ -0,0 +1,1364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/crypto/ssh"
+)
+
+type copyFunc func(client *ssh.Client, source string, target string) (int64, error)
+
+// transfer describes the copy of a single file from source to target.
+type transfer struct {
+	Source string
+	Target string
+	// Info describes the local source file of an upload.
+	Info os.FileInfo
+	// Link is the target of a symlink that is recreated rather than copied.
+	Link string
+	// Root is the local source directory in which an uploaded file was found by walking it.
+	Root string
+	// Skip is the reason why the file is not copied, if any.
+	Skip string
+}
+
+// Reasons for skipping a file.
+const (
+	skipExcluded  = "excluded"
+	skipExists    = "exists"
+	skipNotNewer  = "not newer"
+	skipIdentical = "identical"
+	skipTooLarge  = "too large"
+	skipComplete  = "complete"
+)
+
+// directory describes a directory that needs to be created.
+type directory struct {
+	Path string
+	// Mode is the permission mode of the directory, zero leaves the default mode of the host.
+	Mode os.FileMode
+	// Info describes the local source directory of an upload.
+	Info os.FileInfo
+}
+
+// plan describes the directories that need to be created and the files that need to be copied.
+type plan struct {
+	Directories []directory
+	Transfers   []transfer
+	// Skipped contains the files that are not copied.
+	Skipped []transfer
+	// Exclude contains the patterns of relative paths that must not be copied.
+	Exclude []string
+	// Hidden is whether files and directories whose name starts with a dot are copied.
+	Hidden bool
+
+	// directories and sources index the planned directories and the sources by target path.
+	directories map[string]bool
+	sources     map[string]string
+}
+
+// newPlan creates an empty plan using the configured exclude patterns.
+func newPlan() (*plan, error) {
+	exclude := getList("EXCLUDE")
+	for _, pattern := range exclude {
+		if !doublestar.ValidatePattern(strings.Trim(pattern, "/")) {
+			return nil, fmt.Errorf("invalid exclude pattern: %s", pattern)
+		}
+	}
+
+	return &plan{Exclude: exclude, Hidden: getBoolDefault("INCLUDE_HIDDEN", true), directories: map[string]bool{}, sources: map[string]string{}}, nil
+}
+
+// hidden reports whether a path found by walking a directory or matching a pattern must not
+// be copied because one of its relative segments is hidden.
+func (p *plan) hidden(relative string) bool {
+	if p.Hidden {
+		return false
+	}
+
+	for _, segment := range strings.Split(relative, "/") {
+		if isHidden(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHidden reports whether the name of a file or directory starts with a dot.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// addFile adds a file transfer to the plan, unless its relative path is excluded.
+func (p *plan) addFile(relative string, t transfer) {
+	if isExcluded(p.Exclude, relative, false) {
+		debugf("Excluding %s", t.Source)
+		t.Skip = skipExcluded
+		p.Skipped = append(p.Skipped, t)
+		return
+	}
+
+	if source, ok := p.sources[t.Target]; ok && source != t.Source {
+		log.Printf("⚠️ %s and %s are both copied to %s, the latter overwrites the former", source, t.Source, t.Target)
+	}
+	p.sources[t.Target] = t.Source
+
+	p.Transfers = append(p.Transfers, t)
+}
+
+// addDirectory adds a directory to the plan, unless its relative path is excluded or it is already planned.
+func (p *plan) addDirectory(relative string, d directory) {
+	if isExcluded(p.Exclude, relative, true) || p.directories[d.Path] {
+		return
+	}
+
+	p.directories[d.Path] = true
+	p.Directories = append(p.Directories, d)
+}
+
+// skipTransfers moves all transfers for which skip returns a reason to the skipped files.
+func (p *plan) skipTransfers(skip func(t transfer) (string, error)) error {
+	var transfers []transfer
+	for _, t := range p.Transfers {
+		reason, err := skip(t)
+		if err != nil {
+			return err
+		}
+
+		if reason == "" {
+			transfers = append(transfers, t)
+			continue
+		}
+
+		debugf("Skipping %s: %s", t.Source, reason)
+		t.Skip = reason
+		p.Skipped = append(p.Skipped, t)
+	}
+	p.Transfers = transfers
+
+	return nil
+}
+
+// checkExtensions returns an error listing all files to transfer whose name does not end with
+// one of the allowed extensions. Extensions are compared case-insensitively and may contain
+// several dots, e.g. ".tar.gz".
+func (p *plan) checkExtensions(allowed []string) error {
+	var rejected []string
+	for _, t := range p.Transfers {
+		name := strings.ToLower(path.Base(slashPath(t.Source)))
+		ok := false
+		for _, extension := range allowed {
+			if strings.HasSuffix(name, "."+strings.TrimPrefix(strings.ToLower(extension), ".")) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			rejected = append(rejected, t.Source)
+		}
+	}
+
+	if len(rejected) > 0 {
+		return fmt.Errorf("extension of %d files is not allowed: %s", len(rejected), strings.Join(rejected, ", "))
+	}
+	return nil
+}
+
+// checkRemotePaths returns an error if a remote path of the plan contains a newline. The remote
+// paths are the targets and directories of uploads, the sources of downloads and both of relays.
+func (p *plan) checkRemotePaths(sources bool, targets bool) error {
+	for _, t := range p.Transfers {
+		if sources {
+			if err := checkRemotePath(t.Source); err != nil {
+				return err
+			}
+		}
+		if targets {
+			if err := checkRemotePath(t.Target); err != nil {
+				return err
+			}
+		}
+	}
+	if !targets {
+		return nil
+	}
+	for _, d := range p.Directories {
+		if err := checkRemotePath(d.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourcePaths returns the source paths of all transfers.
+func (p *plan) sourcePaths() []string {
+	sources := make([]string, 0, len(p.Transfers))
+	for _, t := range p.Transfers {
+		sources = append(sources, t.Source)
+	}
+	return sources
+}
+
+// targetPaths returns the target paths of all transfers.
+func (p *plan) targetPaths() []string {
+	targets := make([]string, 0, len(p.Transfers))
+	for _, t := range p.Transfers {
+		targets = append(targets, t.Target)
+	}
+	return targets
+}
+
+// regularFiles returns the transfers that copy the content of a file rather than recreating a
+// symlink, which are the ones that can be verified.
+func regularFiles(transfers []transfer) []transfer {
+	files := make([]transfer, 0, len(transfers))
+	for _, t := range transfers {
+		if t.Link == "" {
+			files = append(files, t)
+		}
+	}
+	return files
+}
+
+// pruneEmptyDirectories removes the directories that do not contain any of the files to copy.
+func (p *plan) pruneEmptyDirectories(dir func(string) string) {
+	used := map[string]bool{}
+	for _, t := range p.Transfers {
+		for parent := dir(t.Target); !used[parent]; parent = dir(parent) {
+			used[parent] = true
+		}
+	}
+
+	directories := p.Directories[:0]
+	for _, d := range p.Directories {
+		if used[d.Path] {
+			directories = append(directories, d)
+		} else {
+			delete(p.directories, d.Path)
+		}
+	}
+	p.Directories = directories
+}
+
+// addParentDirectories adds the parent directory of every target file to the plan, so that
+// missing target directories are created before the transfer.
+func (p *plan) addParentDirectories(dir func(string) string, mode os.FileMode) {
+	for _, t := range p.Transfers {
+		if parent := dir(t.Target); !p.directories[parent] {
+			p.directories[parent] = true
+			p.Directories = append(p.Directories, directory{Path: parent, Mode: mode})
+		}
+	}
+}
+
+// isExcluded reports whether a slash-separated relative path or any of its parent
+// directories matches one of the patterns. Like rsync, a pattern is matched against
+// the trailing segments of a path, so "*.map" matches at any depth, while a leading
+// slash anchors the pattern and a trailing slash only matches directories.
+func isExcluded(patterns []string, relative string, directory bool) bool {
+	relative = strings.TrimPrefix(path.Clean("/"+relative), "/")
+	if relative == "" {
+		return false
+	}
+
+	segments := strings.Split(relative, "/")
+	for end := len(segments); end > 0; end-- {
+		isDirectory := directory || end < len(segments)
+		for _, pattern := range patterns {
+			if strings.HasSuffix(pattern, "/") {
+				if !isDirectory {
+					continue
+				}
+				pattern = strings.TrimSuffix(pattern, "/")
+			}
+
+			for start := 0; start < end; start++ {
+				if strings.HasPrefix(pattern, "/") && start > 0 {
+					break
+				}
+
+				if matched, _ := doublestar.Match(strings.TrimPrefix(pattern, "/"), strings.Join(segments[start:end], "/")); matched {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Copy transfers the given groups of files between remote host and local machine. If enabled,
+// the connection is re-established with reconnect when it is lost during the transfer.
+func Copy(client *ssh.Client, reconnect func() (*ssh.Client, error), groups []sourceGroup) {
+	direction := os.Getenv("DIRECTION")
+
+	transfers, err := newPlan()
+	if err != nil {
+		log.Fatalf("❌ Failed to %s files: %v", direction, err)
+	}
+
+	modes, err := getFileModes()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse mode: %v", err)
+	}
+	owners, err := getFileOwners()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse owner: %v", err)
+	}
+
+	// Parse the rate limit and the transfer mode before planning, so that invalid values fail early.
+	globalLimiter()
+	transferMode, err := getTransferMode()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse transfer mode: %v", err)
+	}
+	protocol, err := getProtocol()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse protocol: %v", err)
+	}
+	if protocol != ProtocolSCP && transferMode == TransferModeTar {
+		log.Fatalf("❌ Failed to parse protocol: %v", errors.New("sftp is not supported in tar mode"))
+	}
+	compression, err := newCompressor()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse compression: %v", err)
+	}
+	if compression != nil {
+		switch {
+		case direction != DirectionUpload:
+			err = errors.New("compression is only supported for uploads")
+		case transferMode == TransferModeTar:
+			err = errors.New("compression is not supported in tar mode")
+		case compression.mode == CompressStore && (getBool("SIZE_CHECK") || getBool("VERIFY_CHECKSUM")):
+			err = errors.New("stored compressed files cannot be verified against their sources")
+		}
+		if err != nil {
+			log.Fatalf("❌ Failed to parse compression: %v", err)
+		}
+	}
+	resume := getBool("RESUME") && transferMode == TransferModeSCP
+	if resume && direction == DirectionUpload && (getBool("ATOMIC") || compression != nil) {
+		log.Fatalf("❌ Failed to parse resume: %v", errors.New("resuming uploads cannot be combined with atomic or compress"))
+	}
+	diskCheck := getBool("DISK_CHECK")
+	if diskCheck && direction != DirectionUpload {
+		log.Fatalf("❌ Failed to parse disk check: %v", errors.New("checking free space is only supported for uploads"))
+	}
+	deleteSource := getBool("DELETE_SOURCE")
+	if deleteSource && direction != DirectionUpload {
+		log.Fatalf("❌ Failed to parse delete source: %v", errors.New("deleting sources is only supported for uploads"))
+	}
+	backupSuffix, err := getBackupSuffix()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse backup suffix: %v", err)
+	}
+
+	minThroughput, throughputWindow, err := getMinThroughput()
+	if err != nil {
+		log.Fatalf("❌ Failed to parse min throughput: %v", err)
+	}
+
+	// Atomic uploads are moved into place once all files were transferred and verified.
+	atomicUpload := getBool("ATOMIC") && direction == DirectionUpload && transferMode == TransferModeSCP
+
+	cleanTarget := getBool("CLEAN_TARGET")
+	if cleanTarget {
+		if err := checkCleanTargets(direction, groups); err != nil {
+			log.Fatalf("❌ Failed to parse clean target: %v", err)
+		}
+	}
+	deleteExtraneous := getBool("DELETE_EXTRANEOUS")
+	if deleteExtraneous {
+		if err := checkDeleteExtraneous(direction); err != nil {
+			log.Fatalf("❌ Failed to parse delete extraneous: %v", err)
+		}
+	}
+
+	copy, emoji := copyTo, "🔼"
+	if direction == DirectionDownload {
+		copy, emoji = copyFrom, "🔽"
+	}
+	var auto *fallback
+	if protocol != ProtocolSCP {
+		sftpCopy := sftpCopyTo
+		if direction == DirectionDownload {
+			sftpCopy = sftpCopyFrom
+		}
+
+		if protocol == ProtocolAuto {
+			auto = &fallback{scp: copy, sftp: sftpCopy}
+			copy = auto.copy
+		} else {
+			copy = sftpCopy
+		}
+	}
+	if compression != nil {
+		compression.upload, copy = copy, compression.copy
+	}
+	var resumed *resumer
+	if resume {
+		resumed = newResumer(copy)
+		copy = resumed.upload
+		if direction == DirectionDownload {
+			copy = resumed.download
+		}
+	}
+
+	for _, group := range groups {
+		if direction == DirectionDownload {
+			var folder bool
+			if group.Target, folder = ExpandHostPlaceholder(group.Target, os.Getenv("HOST")); folder {
+				group.Folder = true
+			}
+			err = PlanDownload(client, transfers, group)
+		}
+		if direction == DirectionUpload {
+			err = PlanUpload(transfers, group, remoteSide{client})
+		}
+		if err != nil {
+			log.Fatalf("❌ Failed to %s files: %v", direction, err)
+		}
+	}
+
+	// Stored compressed files keep the extension of their source followed by .gz.
+	if compression != nil && compression.mode == CompressStore {
+		for i := range transfers.Transfers {
+			transfers.Transfers[i].Target += ".gz"
+		}
+	}
+
+	if err := transfers.checkRemotePaths(direction == DirectionDownload, direction == DirectionUpload); err != nil {
+		log.Fatalf("❌ Failed to %s files: %v", direction, err)
+	}
+	if allowed := getCommaList("ALLOWED_EXTENSIONS"); len(allowed) > 0 {
+		if err := transfers.checkExtensions(allowed); err != nil {
+			log.Fatalf("❌ Failed to %s files: %v", direction, err)
+		}
+	}
+
+	if getBool("LIST_ONLY") {
+		if err := ListFiles(client, transfers, direction); err != nil {
+			log.Fatalf("❌ Failed to list files: %v", err)
+		}
+		return
+	}
+
+	if os.Getenv("MAX_FILE_SIZE") != "" {
+		if err := SkipTooLarge(client, transfers, direction); err != nil {
+			log.Fatalf("❌ Failed to %s files: %v", direction, err)
+		}
+	}
+
+	// The remote targets are compared before cleaning, but they will be gone by the time the
+	// files are uploaded, so nothing is skipped because of them.
+	compareTargets := direction == DirectionDownload || !cleanTarget
+
+	// Completely downloaded files are skipped whether targets are overwritten or not.
+	if direction == DirectionDownload && resume {
+		if err := SkipComplete(client, transfers); err != nil {
+			log.Fatalf("❌ Failed to check remote sources: %v", err)
+		}
+	}
+
+	if !getBoolDefault("OVERWRITE", true) && compareTargets {
+		exists := localExists
+		if direction == DirectionDownload && resume {
+			// Partially downloaded files are not skipped, so that their download is resumed.
+			exists = func(target string) bool {
+				info, err := os.Lstat(target)
+				return err == nil && !info.Mode().IsRegular()
+			}
+		} else if direction == DirectionUpload && resume {
+			// Partially uploaded files are not skipped, so that their upload is resumed.
+			remote, err := RemoteStat(client, transfers.targetPaths())
+			if err != nil {
+				log.Fatalf("❌ Failed to check remote targets: %v", err)
+			}
+			sizes := map[string]int64{}
+			for _, t := range transfers.Transfers {
+				sizes[t.Target] = t.Info.Size()
+			}
+			exists = func(target string) bool {
+				info, ok := remote[target]
+				return ok && info.Size >= sizes[target]
+			}
+		} else if direction == DirectionUpload {
+			existing, err := RemoteExists(client, transfers.targetPaths())
+			if err != nil {
+				log.Fatalf("❌ Failed to check remote targets: %v", err)
+			}
+			exists = func(target string) bool { return existing[target] }
+		}
+
+		if err := SkipExisting(transfers, exists); err != nil {
+			log.Fatalf("❌ Failed to %s files: %v", direction, err)
+		}
+	}
+
+	if getBool("IF_NEWER") && compareTargets {
+		if err := SkipNotNewer(client, transfers, direction); err != nil {
+			log.Fatalf("❌ Failed to compare modification times: %v", err)
+		}
+	}
+
+	if getBool("CHECKSUM_SKIP") && compareTargets {
+		if err := SkipIdentical(client, transfers, direction); err != nil {
+			log.Fatalf("❌ Failed to compare checksums: %v", err)
+		}
+	}
+
+	// Empty directories of recursive copies are created, unless they are excluded explicitly.
+	if !getBoolDefault("INCLUDE_EMPTY_DIRS", true) {
+		if direction == DirectionUpload {
+			transfers.pruneEmptyDirectories(path.Dir)
+		} else {
+			transfers.pruneEmptyDirectories(filepath.Dir)
+		}
+	}
+
+	if direction == DirectionUpload && getBoolDefault("CREATE_TARGET", true) {
+		transfers.addParentDirectories(path.Dir, 0)
+	}
+	if direction == DirectionDownload {
+		transfers.addParentDirectories(filepath.Dir, getMode("LOCAL_DIR_MODE", 0755))
+	}
+
+	if getBool("DRY_RUN") {
+		PrintPlan(transfers)
+		if cleanTarget {
+			if err := CleanTargets(client, groups, true); err != nil {
+				log.Fatalf("❌ Failed to clean target: %v", err)
+			}
+		}
+		if deleteExtraneous {
+			extraneous, err := ExtraneousFiles(client, transfers, groups)
+			if err != nil {
+				log.Fatalf("❌ Failed to list extraneous files: %v", err)
+			}
+			for _, p := range extraneous {
+				log.Printf("🗑️ Would delete %s", p)
+			}
+		}
+		return
+	}
+
+	check := CheckRemoteSCP
+	if transferMode == TransferModeTar {
+		check = CheckRemoteTar
+	}
+	if protocol == ProtocolSFTP {
+		check = CheckRemoteSFTP
+	}
+	if auto != nil {
+		check = auto.check
+	}
+	if err := check(client); err != nil {
+		log.Fatalf("❌ Failed to %s files: %v", direction, err)
+	}
+
+	if diskCheck {
+		if err := CheckFreeSpace(client, transfers); err != nil {
+			log.Fatalf("❌ Failed to %s files: %v", direction, err)
+		}
+	}
+
+	if command := os.Getenv("PRE_COMMAND"); strings.TrimSpace(command) != "" {
+		if err := RunHook(client, "pre command", expandCommand(command, groups, transfers.Transfers, direction)); err != nil {
+			log.Fatalf("❌ Failed to run pre command: %v", err)
+		}
+	}
+
+	if cleanTarget {
+		if err := CleanTargets(client, groups, false); err != nil {
+			log.Fatalf("❌ Failed to clean target: %v", err)
+		}
+	}
+
+	log.Printf("%s %sing ...\n", emoji, strings.Title(direction))
+	if len(transfers.Directories) > 0 {
+		if direction == DirectionUpload {
+			err = CreateRemoteDirectories(client, transfers.Directories)
+		} else {
+			err = CreateLocalDirectories(transfers.Directories)
+		}
+		if err != nil {
+			log.Fatalf("❌ Failed to create target directory: %v", err)
+		}
+	}
+
+	if atomicUpload {
+		var targets []string
+		for _, t := range regularFiles(transfers.Transfers) {
+			targets = append(targets, t.Target)
+		}
+		// A concurrent run may still be writing its temporary files for as long as it may run.
+		maxAge := getDuration("ACTION_TIMEOUT", defaultActionTimeout)
+		if maxAge <= 0 {
+			maxAge = defaultActionTimeout
+		}
+		if err := CleanTemporaryFiles(client, targets, maxAge); err != nil {
+			log.Fatalf("❌ Failed to remove leftover temporary files: %v", err)
+		}
+	}
+
+	results := NewReport(direction)
+	results.Totals.Directories = len(transfers.Directories)
+	for _, t := range transfers.Skipped {
+		results.Skip(t)
+	}
+
+	// Backups are taken from the live targets, before any of them is overwritten.
+	if backupSuffix != "" {
+		var targets []string
+		for _, t := range regularFiles(transfers.Transfers) {
+			targets = append(targets, t.Target)
+		}
+
+		var backups map[string]string
+		if direction == DirectionUpload {
+			backups, err = BackupRemote(client, targets, backupSuffix)
+		} else {
+			backups, err = BackupLocal(targets, backupSuffix)
+		}
+		if err != nil {
+			log.Fatalf("❌ Failed to back up existing targets: %v", err)
+		}
+		results.Backups = backups
+		for target, backup := range backups {
+			debugf("Backed up %s to %s", target, backup)
+		}
+	}
+
+	reconnects := 0
+	if getBool("RECONNECT") {
+		reconnects = getInt("RECONNECT_ATTEMPTS", 3)
+	}
+	conn := &connection{client: client, reconnect: reconnect, attempts: reconnects}
+
+	// Report the files transferred so far and close the connection if the run is cancelled.
+	planned := len(transfers.Transfers)
+	OnCancel(func() {
+		results.Cancel(planned)
+		conn.current().Close()
+	})
+
+	// Only the files that were transferred are verified and have their ownership and mode changed.
+	continueOnError := getBool("CONTINUE_ON_ERROR")
+	quiet := getBool("QUIET")
+	copied := make([]bool, len(transfers.Transfers))
+	temporaries := make([]string, len(transfers.Transfers))
+
+	// The per file command runs as soon as a file landed, which is only after all files were
+	// transferred in tar mode and for atomic uploads that are moved into place.
+	perFileCommand := strings.TrimSpace(os.Getenv("PER_FILE_POST_COMMAND"))
+
+	var failure error
+	var mu sync.Mutex
+	stopWatchdog := startThroughputWatchdog(minThroughput, throughputWindow, func(err error) {
+		results.Finish()
+		log.Fatalf("❌ Failed to %s files: %v", direction, err)
+	})
+	if transferMode == TransferModeTar {
+		if failure = CopyTar(client, transfers.Transfers, results, direction); failure == nil {
+			for i := range copied {
+				copied[i] = true
+			}
+		}
+	} else {
+		stopHeartbeat := startHeartbeat(len(transfers.Transfers), results.Completed)
+		forEachParallel(len(transfers.Transfers), getConcurrency(), func(i int) bool {
+			t := transfers.Transfers[i]
+			start := time.Now()
+			staged := t
+			if atomicUpload && t.Link == "" {
+				staged.Target = temporaryName(t.Target)
+			}
+			n, err := conn.copyFile(copy, staged)
+			if err == nil && perFileCommand != "" && staged.Target == t.Target {
+				err = RunFileHook(conn.current(), perFileCommand, t, direction)
+			}
+			if err != nil {
+				if staged.Target != t.Target {
+					removeRemote(conn.current(), staged.Target)
+				}
+				results.Fail(t, time.Since(start), err)
+
+				// Continue with the next file, unless there is no connection to transfer it with.
+				if continueOnError && !ConnectionLost(conn.current(), getDuration("TIMEOUT", defaultTimeout)) {
+					log.Printf("⚠️ Failed to %s %s: %v", direction, t.Source, err)
+					return true
+				}
+
+				mu.Lock()
+				if failure == nil {
+					failure = err
+				}
+				mu.Unlock()
+				return false
+			}
+			elapsed := time.Since(start)
+			results.Transfer(t, n, elapsed)
+			copied[i] = true
+			temporaries[i] = staged.Target
+			if !quiet {
+				log.Printf("📑 %s >> %s (%s)", t.Source, t.Target, formatThroughput(n, elapsed))
+			}
+			return true
+		})
+		stopHeartbeat()
+	}
+	stopWatchdog()
+	if auto != nil {
+		used := ProtocolSCP
+		if auto.usingSFTP() {
+			used = ProtocolSFTP
+		}
+		log.Printf("🔀 Transferred files with %s", used)
+	}
+	if compression != nil {
+		results.Compressed(compression.sizes)
+	}
+	if resumed != nil {
+		results.Resumed(resumed.reused)
+	}
+	client = conn.current()
+
+	// Atomic uploads are verified under their temporary names before they are moved into
+	// place, so that the targets hold either the old or the new complete file.
+	succeeded := make([]transfer, 0, len(transfers.Transfers))
+	staged := make([]transfer, 0, len(transfers.Transfers))
+	var renames []rename
+	for i, t := range transfers.Transfers {
+		if !copied[i] {
+			continue
+		}
+		succeeded = append(succeeded, t)
+		if temporaries[i] != "" && temporaries[i] != t.Target {
+			renames = append(renames, rename{From: temporaries[i], To: t.Target})
+			t.Target = temporaries[i]
+		}
+		staged = append(staged, t)
+	}
+	transfers.Transfers = succeeded
+
+	if failure != nil {
+		removeTemporaryFiles(client, renames)
+		results.Finish()
+		log.Fatalf("❌ Failed to %s file from remote: %v", direction, failure)
+	}
+
+	// Recreated symlinks may point to files that do not exist on the remote host.
+	files := regularFiles(staged)
+
+	if direction == DirectionUpload && getBool("VERIFY_EXISTS") {
+		if err := VerifyExists(client, files, getBool("VERIFY_NON_EMPTY")); err != nil {
+			removeTemporaryFiles(client, renames)
+			results.Finish()
+			log.Fatalf("❌ Failed to verify targets: %v", err)
+		}
+		log.Printf("🔎 Verified that %d files exist", len(files))
+	}
+
+	if getBool("SIZE_CHECK") {
+		if err := VerifySizes(client, files, direction); err != nil {
+			removeTemporaryFiles(client, renames)
+			results.Finish()
+			log.Fatalf("❌ Failed to verify sizes: %v", err)
+		}
+		log.Printf("📏 Verified sizes of %d files", len(files))
+	}
+
+	if getBool("VERIFY_CHECKSUM") {
+		digests, err := VerifyChecksums(client, files, direction)
+		results.Checksums(digests)
+		if err != nil {
+			removeTemporaryFiles(client, renames)
+			results.Finish()
+			log.Fatalf("❌ Failed to verify checksums: %v", err)
+		}
+		log.Printf("🔐 Verified checksums of %d files", len(digests))
+	}
+
+	if err := RenameRemote(client, renames); err != nil {
+		removeTemporaryFiles(client, renames)
+		results.Finish()
+		log.Fatalf("❌ Failed to %s files: %v", direction, err)
+	}
+	if perFileCommand != "" && (transferMode == TransferModeTar || len(renames) > 0) {
+		moved := map[string]bool{}
+		for _, r := range renames {
+			moved[r.To] = true
+		}
+		for _, t := range transfers.Transfers {
+			if transferMode != TransferModeTar && !moved[t.Target] {
+				continue
+			}
+			if err := RunFileHook(client, perFileCommand, t, direction); err != nil {
+				results.Finish()
+				log.Fatalf("❌ Failed to run per file post command for %s: %v", t.Source, err)
+			}
+		}
+	}
+
+	if direction == DirectionUpload {
+		changed, err := ApplyOwnership(client, transfers, owners)
+		results.Totals.OwnershipChanges = changed
+		if err != nil {
+			results.Finish()
+			log.Fatalf("❌ Failed to change ownership: %v", err)
+		}
+		if changed > 0 {
+			log.Printf("👤 Changed ownership of %d paths", changed)
+		}
+
+		// A single mode is already set by the scp protocol, unless the files took another path.
+		scpMode := modes.single() && !getBool("PRESERVE_MODE") && protocol == ProtocolSCP && transferMode == TransferModeSCP && compression == nil && !resume
+		if scpMode {
+			for _, t := range regularFiles(transfers.Transfers) {
+				debugf("Mode of %s set to %04o by the scp protocol", t.Target, modes.Default)
+			}
+		} else {
+			changed, err = ApplyMode(client, transfers, modes)
+		}
+		if err != nil {
+			results.Finish()
+			log.Fatalf("❌ Failed to change mode: %v", err)
+		}
+		if changed > 0 {
+			log.Printf("🔒 Changed mode of %d files", changed)
+		}
+	}
+
+	// Extraneous files are only deleted if all files arrived, since a failed file may have
+	// replaced one of them.
+	if deleteExtraneous {
+		if results.Totals.Failed > 0 {
+			log.Printf("⚠️ Skipping deletion of extraneous files: %d files failed to transfer", results.Totals.Failed)
+		} else {
+			extraneous, err := ExtraneousFiles(client, transfers, groups)
+			if err == nil {
+				err = DeleteRemote(client, extraneous)
+			}
+			if err != nil {
+				results.Finish()
+				log.Fatalf("❌ Failed to delete extraneous files: %v", err)
+			}
+			for _, p := range extraneous {
+				log.Printf("🗑️ Deleted %s", p)
+			}
+			log.Printf("🧹 Deleted %d extraneous remote paths", len(extraneous))
+		}
+	}
+
+	// The post command only runs if all files arrived, e.g. so that a service is not restarted
+	// with a partial deployment.
+	if command := os.Getenv("POST_COMMAND"); strings.TrimSpace(command) != "" {
+		if results.Totals.Failed > 0 {
+			log.Printf("⚠️ Skipping post command: %d files failed to transfer", results.Totals.Failed)
+		} else if err := RunHook(client, "post command", expandCommand(command, groups, transfers.Transfers, direction)); err != nil {
+			results.Finish()
+			log.Fatalf("❌ Failed to run post command: %v", err)
+		}
+	}
+
+	// Sources are only deleted once every step that may still fail the run has succeeded.
+	if deleteSource {
+		deleted, err := DeleteSources(transfers.Transfers, getBool("PRUNE_SOURCE_DIRS"))
+		if err != nil {
+			results.Finish()
+			log.Fatalf("❌ Failed to delete sources: %v", err)
+		}
+		log.Printf("🗑️ Deleted %d source files", deleted)
+	}
+
+	results.Finish()
+	results.CheckFailures()
+	results.CheckEmpty()
+}
+
+// PrintPlan logs the directories that would be created and the files that would be copied or
+// skipped, and sets the outputs accordingly, without writing anything on either side.
+func PrintPlan(transfers *plan) {
+	for _, d := range transfers.Directories {
+		log.Printf("📁 Would create %s", d.Path)
+	}
+	for _, t := range transfers.Transfers {
+		log.Printf("📑 Would copy %s >> %s", t.Source, t.Target)
+	}
+	for _, t := range transfers.Skipped {
+		log.Printf("⏭️ Would skip %s: %s", t.Source, t.Skip)
+	}
+
+	summary := fmt.Sprintf("📡 Planned %d files", len(transfers.Transfers))
+	if len(transfers.Transfers) == 1 {
+		summary = "📡 Planned 1 file"
+	}
+	log.Printf("%s, skipped %d", summary, len(transfers.Skipped))
+	SetOutput("transferred_count", "0")
+	SetOutput("skipped_count", fmt.Sprint(len(transfers.Skipped)))
+	SetOutput("planned_count", fmt.Sprint(len(transfers.Transfers)))
+}
+
+// ListFiles logs the files that the sources resolve to with their sizes and sets them as output,
+// one per line, instead of transferring them.
+func ListFiles(client *ssh.Client, transfers *plan, direction string) error {
+	var infos map[string]remoteFileInfo
+	if direction == DirectionDownload {
+		var err error
+		if infos, err = RemoteStat(client, transfers.sourcePaths()); err != nil {
+			return err
+		}
+	}
+
+	var total int64
+	for _, t := range transfers.Transfers {
+		size := infos[t.Source].Size
+		if direction == DirectionUpload {
+			size = t.Info.Size()
+		}
+		total += size
+
+		log.Printf("📑 %s (%s)", t.Source, formatBytes(size))
+	}
+
+	log.Printf("📡 Found %d files (%s)", len(transfers.Transfers), formatBytes(total))
+	SetOutput("files", strings.Join(transfers.sourcePaths(), "\n"))
+
+	return nil
+}
+
+// SkipExisting skips all transfers whose target already exists, or fails if the configured
+// mode for existing files is "fail".
+func SkipExisting(transfers *plan, exists func(target string) bool) error {
+	fail := false
+	switch mode := strings.TrimSpace(os.Getenv("EXISTING_MODE")); mode {
+	case "", "skip":
+	case "fail":
+		fail = true
+	default:
+		return fmt.Errorf("invalid existing mode: %s", mode)
+	}
+
+	return transfers.skipTransfers(func(t transfer) (string, error) {
+		if !exists(t.Target) {
+			return "", nil
+		}
+
+		if fail {
+			return "", fmt.Errorf("target %s already exists", t.Target)
+		}
+		return skipExists, nil
+	})
+}
+
+// SkipNotNewer skips all transfers whose target is at least as new as the source. Remote
+// modification times are read in batches and, like the local ones, truncated to seconds.
+// The configured tolerance allows for clock skew between the runner and the remote host.
+func SkipNotNewer(client *ssh.Client, transfers *plan, direction string) error {
+	tolerance := getDuration("IF_NEWER_TOLERANCE", 0)
+
+	var sources, targets map[string]remoteFileInfo
+	var err error
+	if direction == DirectionUpload {
+		targets, err = RemoteStat(client, transfers.targetPaths())
+	} else {
+		sources, err = RemoteStat(client, transfers.sourcePaths())
+	}
+	if err != nil {
+		return err
+	}
+
+	return transfers.skipTransfers(func(t transfer) (string, error) {
+		var source, target time.Time
+		var ok bool
+		if direction == DirectionUpload {
+			source = t.Info.ModTime()
+			remote, found := targets[t.Target]
+			target, ok = remote.ModTime, found
+		} else {
+			remote, found := sources[t.Source]
+			if !found {
+				return "", fmt.Errorf("failed to read modification time of %s", t.Source)
+			}
+			source = remote.ModTime
+
+			info, err := os.Stat(t.Target)
+			if ok = err == nil; ok {
+				target = info.ModTime()
+			}
+		}
+
+		if !ok {
+			return "", nil
+		}
+
+		source, target = source.Truncate(time.Second), target.Truncate(time.Second)
+		debugf("Comparing %s modified at %v with %s modified at %v", t.Source, source, t.Target, target)
+		if target.Before(source.Add(-tolerance)) {
+			return "", nil
+		}
+		return skipNotNewer, nil
+	})
+}
+
+// SkipTooLarge skips all transfers whose source is larger than MAX_FILE_SIZE, or fails if the
+// configured mode for large files is "fail". The sizes of remote sources are read in batches.
+func SkipTooLarge(client *ssh.Client, transfers *plan, direction string) error {
+	limit, err := parseBytes(os.Getenv("MAX_FILE_SIZE"))
+	if err != nil {
+		return fmt.Errorf("invalid max file size: %v", err)
+	}
+
+	fail := false
+	switch mode := strings.TrimSpace(os.Getenv("MAX_FILE_SIZE_MODE")); mode {
+	case "", "skip":
+	case "fail":
+		fail = true
+	default:
+		return fmt.Errorf("invalid max file size mode: %s", mode)
+	}
+
+	var sources map[string]remoteFileInfo
+	if direction != DirectionUpload {
+		if sources, err = RemoteStat(client, transfers.sourcePaths()); err != nil {
+			return err
+		}
+	}
+
+	return transfers.skipTransfers(func(t transfer) (string, error) {
+		size := sources[t.Source].Size
+		if direction == DirectionUpload {
+			size = t.Info.Size()
+		}
+
+		if float64(size) <= limit {
+			return "", nil
+		}
+
+		if fail {
+			return "", fmt.Errorf("source %s has %s, which exceeds the max file size of %s", t.Source, formatBytes(size), formatBytes(int64(limit)))
+		}
+		log.Printf("⚠️ Skipping %s: %s exceeds the max file size", t.Source, formatBytes(size))
+		return skipTooLarge, nil
+	})
+}
+
+// localExists reports whether a local path exists.
+func localExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// CreateRemoteDirectories creates the given directories and their parents on the remote host.
+// If modes are preserved, the directories are updated to the mode of their local counterpart.
+// A remote directory mode is applied to the directories that did not exist before.
+func CreateRemoteDirectories(client *ssh.Client, directories []directory) error {
+	paths := make([]string, len(directories))
+	modes := map[os.FileMode][]string{}
+	for i, directory := range directories {
+		paths[i] = directory.Path
+		if directory.Mode != 0 {
+			modes[directory.Mode] = append(modes[directory.Mode], directory.Path)
+		}
+	}
+
+	dirMode := getMode("REMOTE_DIR_MODE", 0)
+	var created []string
+	if dirMode != 0 {
+		var err error
+		if created, err = missingDirectories(client, paths); err != nil {
+			return err
+		}
+	}
+
+	if err := RunBatched(client, "mkdir -p --", paths); err != nil {
+		if message := err.Error(); strings.Contains(message, "Not a directory") || strings.Contains(message, "File exists") {
+			return fmt.Errorf("path exists but is not a directory: %v", err)
+		}
+		if strings.Contains(err.Error(), "Permission denied") {
+			return fmt.Errorf("permission denied: %v", err)
+		}
+		return err
+	}
+
+	if getBool("PRESERVE_MODE") {
+		for mode, paths := range modes {
+			if err := RunBatched(client, fmt.Sprintf("chmod %04o --", mode), paths); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(created) > 0 {
+		if err := RunBatched(client, fmt.Sprintf("chmod %04o --", dirMode), created); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// missingDirectories returns the given remote directories and their parents that do not
+// exist yet, which are the ones that "mkdir -p" creates.
+func missingDirectories(client *ssh.Client, paths []string) ([]string, error) {
+	seen := map[string]bool{}
+	var candidates []string
+	for _, p := range paths {
+		for dir := path.Clean(p); dir != "/" && dir != "." && !seen[dir]; dir = path.Dir(dir) {
+			seen[dir] = true
+			candidates = append(candidates, dir)
+		}
+	}
+
+	existing, err := RemoteExists(client, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, dir := range candidates {
+		if !existing[dir] {
+			missing = append(missing, dir)
+		}
+	}
+	return missing, nil
+}
+
+// CreateLocalDirectories creates the given directories and their parents on the local machine.
+func CreateLocalDirectories(directories []directory) error {
+	for _, directory := range directories {
+		if info, err := os.Stat(directory.Path); err == nil && !info.IsDir() {
+			return fmt.Errorf("%s exists but is not a directory", directory.Path)
+		}
+
+		if err := os.MkdirAll(directory.Path, directory.Mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// connection shares a client between concurrent transfers and replaces it once if the
+// connection is lost, however many transfers notice it.
+type connection struct {
+	mu        sync.Mutex
+	client    *ssh.Client
+	reconnect func() (*ssh.Client, error)
+	attempts  int
+}
+
+// current returns the client to use for the next transfer.
+func (c *connection) current() *ssh.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// canReconnect reports whether attempts to reconnect are left.
+func (c *connection) canReconnect() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attempts > 0
+}
+
+// recover replaces the failed client if it is still in use, and reports whether a client
+// that is connected is available.
+func (c *connection) recover(failed *ssh.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != failed {
+		return true
+	}
+
+	for c.attempts > 0 {
+		c.attempts--
+		time.Sleep(getDuration("RECONNECT_DELAY", 2*time.Second))
+		client, err := c.reconnect()
+		if err == nil {
+			c.client = client
+			return true
+		}
+		log.Printf("⚠️ Failed to reconnect: %v", err)
+	}
+
+	return false
+}
+
+// copyFile transfers a single file and resumes with it if the connection was lost and could
+// be re-established, rather than failing the file. Transient failures are retried up to
+// FILE_RETRIES times, doubling the delay after each attempt. Each attempt overwrites the
+// partial target of the previous one.
+func (c *connection) copyFile(copy copyFunc, t transfer) (int64, error) {
+	retries := getInt("FILE_RETRIES", 0)
+	delay := getDuration("FILE_RETRY_DELAY", time.Second)
+
+	if t.Link != "" {
+		copy = copyLink
+	}
+
+	for attempt := 1; ; {
+		client := c.current()
+		n, err := copy(client, t.Source, t.Target)
+		if err == nil {
+			return n, nil
+		}
+
+		if strings.Contains(err.Error(), "administratively prohibited") {
+			return n, fmt.Errorf("%v, the host may limit the number of sessions per connection, please lower the concurrency", err)
+		}
+
+		if c.canReconnect() && ConnectionLost(client, getDuration("TIMEOUT", defaultTimeout)) {
+			log.Printf("🔌 Connection lost while copying %s, reconnecting: %v", t.Source, err)
+			if !c.recover(client) {
+				return n, err
+			}
+			continue
+		}
+
+		if attempt > retries || !isTransient(err) {
+			return n, err
+		}
+		log.Printf("🔄 Retrying %s in %v (attempt %d of %d): %v", t.Source, delay, attempt, retries, err)
+		time.Sleep(delay)
+		attempt++
+		delay *= 2
+	}
+}
+
+// isTransient reports whether an error is likely to go away when the transfer is retried, such
+// as an I/O or network error, as opposed to e.g. a missing file or a denied permission.
+func isTransient(err error) bool {
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, permanent := range []string{"permission denied", "no such file", "not a directory", "is a directory", "no space left", "read-only file system"} {
+		if strings.Contains(message, permanent) {
+			return false
+		}
+	}
+	for _, transient := range []string{"eof", "connection reset", "broken pipe", "timed out", "timeout", "i/o error", "input/output error", "unexpected end of file"} {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forEachParallel calls do for the indexes up to count, with at most concurrency calls running
+// at the same time. Once a call returns false, no further calls are started.
+func forEachParallel(count int, concurrency int, do func(i int) bool) {
+	indexes := make(chan int)
+	stop := make(chan struct{})
+	var once sync.Once
+	var wg sync.WaitGroup
+
+	for w := 0; w < concurrency && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if !do(i) {
+					once.Do(func() { close(stop) })
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < count; i++ {
+		select {
+		case indexes <- i:
+		case <-stop:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// getConcurrency returns the number of files to transfer at the same time.
+func getConcurrency() int {
+	concurrency := getInt("CONCURRENCY", 1)
+	if concurrency < 1 {
+		log.Fatalf("❌ Failed to parse concurrency: %v", errors.New("concurrency must be at least 1"))
+	}
+	return concurrency
+}
+
+// copyLink recreates a local symlink at a remote path with the same target.
+func copyLink(client *ssh.Client, local string, remote string) (int64, error) {
+	link, err := os.Readlink(local)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := RunCommand(client, "ln -sfn -- "+shellQuote(link)+" "+shellQuote(remote)); err != nil {
+		return 0, fmt.Errorf("failed to create symlink: %v", err)
+	}
+	return 0, nil
+}
+
+// removeRemote deletes a file on the remote host, logging a warning on failure.
+func removeRemote(client *ssh.Client, file string) {
+	if _, err := RunCommand(client, "rm -f -- "+shellQuote(file)); err != nil {
+		log.Printf("⚠️ Failed to remove temporary file %s: %v", file, err)
+	}
+}
+
+// formatThroughput formats a byte count with the time it took to transfer and the resulting rate.
+func formatThroughput(bytes int64, elapsed time.Duration) string {
+	precision := 100 * time.Millisecond
+	if elapsed < time.Second {
+		precision = time.Millisecond
+	}
+
+	formatted := formatBytes(bytes) + " in " + elapsed.Round(precision).String()
+	if elapsed > 0 {
+		formatted += " at " + formatBytes(int64(float64(bytes)/elapsed.Seconds())) + "/s"
+	}
+	return formatted
+}
+
+// formatBytes formats a byte count using binary units.
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// emptySource reports a source that does not yield any files. This is a warning,
+// unless failing on empty sources has been requested.
+func emptySource(format string, a ...interface{}) error {
+	if getBool("FAIL_ON_EMPTY") {
+		return fmt.Errorf(format, a...)
+	}
+
+	log.Printf("⚠️ "+strings.ToUpper(format[:1])+format[1:], a...)
+	return nil
+}
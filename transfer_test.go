@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnectionRecoverConcurrently(t *testing.T) {
+	unsetEnv(t, "RECONNECT_DELAY")
+	os.Setenv("RECONNECT_DELAY", "1ms")
+
+	var reconnects int32
+	failed := &ssh.Client{}
+	c := &connection{
+		client: failed,
+		reconnect: func() (*ssh.Client, error) {
+			atomic.AddInt32(&reconnects, 1)
+			return nil, errors.New("connection refused")
+		},
+		attempts: 3,
+	}
+
+	// The workers check for attempts and recover at the same time, as they do after losing
+	// the connection in the middle of their transfers.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.canReconnect() {
+				c.recover(failed)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if actual := atomic.LoadInt32(&reconnects); actual != 3 {
+		t.Errorf("reconnected %d times, expected 3", actual)
+	}
+	if c.canReconnect() {
+		t.Error("attempts are left after all of them failed")
+	}
+}
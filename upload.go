@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// globMeta contains the characters that turn a source into a glob pattern.
+const globMeta = "*?[{"
+
+// PlanUpload maps the local source files and directories of a group to remote target files.
+// Glob patterns are expanded, and directories are walked recursively with their layout
+// being recreated below the target. A single file is copied to the exact target path, unless
+// the target ends with a slash or is an existing directory on the given side.
+func PlanUpload(transfers *plan, group sourceGroup, side targetSide) error {
+	targetFileOrFolder := group.Target
+
+	strip := getInt("STRIP_COMPONENTS", 0)
+	if strip < 0 {
+		return fmt.Errorf("invalid strip components: %d", strip)
+	}
+
+	// Expand patterns first, so that the common root of all sources is known. Rename file if
+	// there is only one source file.
+	rename := len(group.Sources) == 1 && !group.Folder && !strings.ContainsAny(group.Sources[0], globMeta)
+	if rename && side.IsDir(targetFileOrFolder) {
+		rename = false
+	}
+	var sources []string
+	for _, sourceFile := range group.Sources {
+		if !strings.ContainsAny(sourceFile, globMeta) {
+			sources = append(sources, sourceFile)
+			continue
+		}
+
+		matches, err := doublestar.FilepathGlob(sourceFile)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %s: %v", sourceFile, err)
+		}
+
+		matches = hiddenMatches(transfers, sourceFile, matches)
+		if len(matches) == 0 {
+			if err := emptySource("pattern %s does not match any files", sourceFile); err != nil {
+				return err
+			}
+			continue
+		}
+		sources = append(sources, matches...)
+	}
+
+	layout := layout{Flatten: getBoolDefault("FLATTEN", true) && strip == 0, Strip: strip}
+	if !layout.Flatten && strip == 0 {
+		layout.Root = commonRoot(sources)
+	}
+
+	for _, sourceFile := range sources {
+		if err := planLocal(transfers, sourceFile, targetFileOrFolder, rename, layout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// layout describes how the paths of local source files are recreated below the target.
+type layout struct {
+	// Flatten copies files into the target folder by name and directories by their contents.
+	// Otherwise the source path relative to the root, or without the stripped leading elements
+	// if there is no root, is recreated.
+	Flatten bool
+	Root    string
+	Strip   int
+}
+
+// relative returns the slash-separated path of a source file that is recreated below the target.
+func (l layout) relative(name string) (string, bool) {
+	if l.Root != "" {
+		relative, err := filepath.Rel(filepath.FromSlash(l.Root), filepath.FromSlash(name))
+		if relative = filepath.ToSlash(relative); err == nil && relative != ".." && !strings.HasPrefix(relative, "../") {
+			return relative, true
+		}
+	}
+
+	return stripComponents(name, l.Strip)
+}
+
+// commonRoot returns the deepest directory that contains all of the given sources, as a
+// slash-separated path. It is empty if there is none, e.g. when mixing absolute and relative paths.
+func commonRoot(sources []string) string {
+	var root []string
+	for i, source := range sources {
+		dir := path.Dir(path.Clean(slashPath(source)))
+		segments := strings.Split(dir, "/")
+		if i == 0 {
+			root = segments
+			continue
+		}
+
+		common := 0
+		for common < len(root) && common < len(segments) && root[common] == segments[common] {
+			common++
+		}
+		root = root[:common]
+	}
+
+	switch {
+	case len(root) == 0:
+		return ""
+	case len(root) == 1 && root[0] == "":
+		return "/"
+	}
+	return strings.Join(root, "/")
+}
+
+// hiddenMatches removes the matches of a pattern that are hidden below its static base,
+// unless the pattern itself names hidden files, e.g. ".*" or "**/.htaccess".
+func hiddenMatches(transfers *plan, pattern string, matches []string) []string {
+	base, rest := doublestar.SplitPattern(filepath.ToSlash(pattern))
+	for _, segment := range strings.Split(rest, "/") {
+		if isHidden(segment) {
+			return matches
+		}
+	}
+
+	var visible []string
+	for _, match := range matches {
+		relative := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(match), base), "/")
+		if base == "." {
+			relative = filepath.ToSlash(match)
+		}
+		if transfers.hidden(relative) {
+			debugf("Skipping hidden %s", match)
+			continue
+		}
+		visible = append(visible, match)
+	}
+	return visible
+}
+
+// planLocal adds a local file or directory to the plan. A file is renamed to the
+// target if rename is set, otherwise it is copied below the target folder according to the layout.
+func planLocal(transfers *plan, sourceFile string, targetFileOrFolder string, rename bool, layout layout) error {
+	symlinks, err := symlinkMode()
+	if err != nil {
+		return err
+	}
+	special, err := specialFileMode()
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(sourceFile)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch symlinks {
+		case symlinksSkip:
+			log.Printf("⚠️ Skipping symlink %s", sourceFile)
+			return nil
+		case symlinksPreserve:
+			if link, err = os.Readlink(sourceFile); err != nil {
+				return err
+			}
+		default:
+			if info, err = followSymlink(sourceFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	if link == "" {
+		if skip, err := skipSpecial(sourceFile, info, special); skip || err != nil {
+			return err
+		}
+	}
+
+	if !info.IsDir() {
+		if rename {
+			transfers.addFile(slashPath(sourceFile), transfer{Source: sourceFile, Target: targetFileOrFolder, Info: info, Link: link})
+			return nil
+		}
+
+		target := path.Join(targetFileOrFolder, filepath.Base(sourceFile))
+		if !layout.Flatten {
+			stripped, ok := layout.relative(slashPath(sourceFile))
+			if !ok {
+				return fmt.Errorf("cannot strip %d components from %s", layout.Strip, sourceFile)
+			}
+			target = path.Join(targetFileOrFolder, stripped)
+
+			// Create the preserved subdirectories of the file.
+			if dir := path.Dir(stripped); dir != "." {
+				transfers.addDirectory(dir, directory{Path: path.Join(targetFileOrFolder, dir)})
+			}
+		}
+
+		transfers.addFile(slashPath(sourceFile), transfer{Source: sourceFile, Target: target, Info: info, Link: link})
+		return nil
+	}
+
+	// Like with scp -r, a directory that is copied by its contents may be nested below the target
+	// in a directory of its name.
+	if layout.Flatten && getBool("INCLUDE_SOURCE_DIR") {
+		targetFileOrFolder = path.Join(targetFileOrFolder, path.Base(slashPath(filepath.Clean(sourceFile))))
+	}
+
+	files := 0
+	err = walkLocal(sourceFile, ".", info, nil, symlinks, func(file string, relative string, info os.FileInfo) error {
+		target := path.Join(targetFileOrFolder, relative)
+		if !layout.Flatten {
+			stripped, ok := layout.relative(slashPath(file))
+			if !ok {
+				// Directories above the stripped components are not recreated.
+				if info.IsDir() {
+					return nil
+				}
+				return fmt.Errorf("cannot strip %d components from %s", layout.Strip, file)
+			}
+			target = path.Join(targetFileOrFolder, stripped)
+		}
+
+		if transfers.hidden(relative) {
+			debugf("Skipping hidden %s", file)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			transfers.addDirectory(relative, directory{Path: target, Mode: info.Mode().Perm(), Info: info})
+			return nil
+		}
+
+		// Preserved symlinks are recreated with the same target.
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		} else if skip, err := skipSpecial(file, info, special); skip || err != nil {
+			return err
+		}
+
+		transfers.addFile(relative, transfer{Source: file, Target: target, Info: info, Link: link, Root: sourceFile})
+		files += 1
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if files == 0 {
+		return emptySource("directory %s does not contain any files", sourceFile)
+	}
+
+	return nil
+}
+
+// slashPath converts a local path to a slash-separated path without volume name, so that
+// it can be used on the remote side.
+func slashPath(name string) string {
+	return remotePath(name, runtime.GOOS == "windows")
+}
+
+// remotePath converts a local path of the given kind of system to a slash-separated path. On
+// Windows, both slashes and backslashes separate elements, and a drive letter or UNC volume is
+// removed, e.g. "D:\a\dist\app.zip" becomes "/a/dist/app.zip". It does not depend on the
+// system it runs on.
+func remotePath(name string, windows bool) string {
+	if !windows {
+		return name
+	}
+
+	name = strings.ReplaceAll(name, `\`, "/")
+	switch {
+	case len(name) >= 2 && name[1] == ':' && ('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z'):
+		// A bare drive like "D:" refers to its current directory.
+		if name = name[2:]; name == "" {
+			name = "."
+		}
+	case strings.HasPrefix(name, "//"):
+		// A UNC path starts with the volume "//server/share".
+		parts := strings.SplitN(name[2:], "/", 3)
+		name = "/"
+		if len(parts) == 3 {
+			name += parts[2]
+		}
+	}
+	return name
+}
+
+// stripComponents removes the given number of leading elements from a slash-separated path,
+// after removing any leading parent directory references. It reports false if the path does
+// not have more elements than are to be stripped.
+func stripComponents(name string, count int) (string, bool) {
+	segments := strings.Split(strings.TrimPrefix(path.Clean(name), "/"), "/")
+	for len(segments) > 1 && segments[0] == ".." {
+		segments = segments[1:]
+	}
+	if len(segments) <= count {
+		return "", false
+	}
+
+	return path.Join(segments[count:]...), true
+}
+
+// walkFunc is called for every file and directory visited by walkLocal with the
+// slash-separated path relative to the root and the information of the file,
+// which describes the target of a followed symlink or a preserved symlink itself.
+// Returning filepath.SkipDir for a directory skips its contents.
+type walkFunc func(file string, relative string, info os.FileInfo) error
+
+// walkLocal walks a local directory tree in lexical order. Symlinks are followed, passed on
+// as they are or skipped, and followed symlinks to one of the directories being walked are skipped to avoid loops.
+func walkLocal(file string, relative string, info os.FileInfo, ancestors []os.FileInfo, symlinks string, fn walkFunc) error {
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor, info) {
+			log.Printf("⚠️ Skipping %s: symlink loop", file)
+			return nil
+		}
+	}
+
+	if err := fn(file, relative, info); err != nil || !info.IsDir() {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	ancestors = append(ancestors, info)
+
+	entries, err := os.ReadDir(file)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		child := filepath.Join(file, entry.Name())
+		childInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if childInfo.Mode()&os.ModeSymlink != 0 {
+			switch symlinks {
+			case symlinksSkip:
+				log.Printf("⚠️ Skipping symlink %s", child)
+				continue
+			case symlinksPreserve:
+				// The symlink itself is passed on rather than the file it points to.
+			default:
+				if childInfo, err = followSymlink(child); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := walkLocal(child, path.Join(relative, entry.Name()), childInfo, ancestors, symlinks, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Modes of handling symlinks of uploads.
+const (
+	// symlinksFollow copies the file or directory a symlink points to.
+	symlinksFollow = "follow"
+	// symlinksPreserve recreates the symlink on the remote host.
+	symlinksPreserve = "preserve"
+	// symlinksSkip ignores symlinks with a warning.
+	symlinksSkip = "skip"
+)
+
+// symlinkMode returns how symlinks are handled, which defaults to following them.
+func symlinkMode() (string, error) {
+	switch mode := strings.TrimSpace(getString("SYMLINKS", os.Getenv("SYMLINK_MODE"))); mode {
+	case "", symlinksFollow:
+		return symlinksFollow, nil
+	case symlinksPreserve, symlinksSkip:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid symlink mode: %s", mode)
+	}
+}
+
+// Modes of handling special files of uploads, e.g. named pipes, sockets and devices.
+const (
+	// specialSkip ignores special files with a warning.
+	specialSkip = "skip"
+	// specialFail fails the upload of the source that contains a special file.
+	specialFail = "fail"
+)
+
+// specialFileMode returns how special files are handled, which defaults to skipping them.
+func specialFileMode() (string, error) {
+	switch mode := strings.TrimSpace(os.Getenv("SPECIAL_FILES")); mode {
+	case "", specialSkip:
+		return specialSkip, nil
+	case specialFail:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid special file mode: %s", mode)
+	}
+}
+
+// skipSpecial reports whether a file is skipped because it is neither a regular file nor a
+// directory, or returns an error if special files fail the upload. Reading a special file may
+// block forever, e.g. for a named pipe without a writer, so it is never transferred.
+func skipSpecial(name string, info os.FileInfo, mode string) (bool, error) {
+	if info.Mode().IsRegular() || info.IsDir() {
+		return false, nil
+	}
+
+	kind := "special file"
+	switch {
+	case info.Mode()&os.ModeNamedPipe != 0:
+		kind = "named pipe"
+	case info.Mode()&os.ModeSocket != 0:
+		kind = "socket"
+	case info.Mode()&os.ModeDevice != 0:
+		kind = "device"
+	}
+
+	if mode == specialFail {
+		return true, fmt.Errorf("%s is a %s, not a regular file", name, kind)
+	}
+	log.Printf("⚠️ Skipping %s: %s, not a regular file", name, kind)
+	return true, nil
+}
+
+// followSymlink returns the file information of the file a symlink points to, naming the
+// target of a broken symlink.
+func followSymlink(name string) (os.FileInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil && os.IsNotExist(err) {
+		if link, linkErr := os.Readlink(name); linkErr == nil {
+			return nil, fmt.Errorf("broken symlink %s points to missing %s", name, link)
+		}
+	}
+	return info, err
+}
+
+// DeleteSources deletes the local sources of transferred files and returns how many were
+// deleted. If prune is set, it also deletes the directories that the deletions leave empty
+// inside the source directories that the files were found in, including those directories.
+func DeleteSources(transfers []transfer, prune bool) (int, error) {
+	deleted := 0
+	for _, t := range transfers {
+		if err := os.Remove(t.Source); err != nil {
+			return deleted, err
+		}
+		deleted += 1
+		log.Printf("🗑️ Deleted %s", t.Source)
+
+		if !prune || t.Root == "" {
+			continue
+		}
+
+		root := filepath.Clean(t.Root)
+		for dir := filepath.Dir(t.Source); ; dir = filepath.Dir(dir) {
+			relative, err := filepath.Rel(root, dir)
+			if err != nil || strings.HasPrefix(relative, "..") {
+				break
+			}
+
+			// Removing a directory that still contains files fails, which ends the pruning.
+			if os.Remove(dir) != nil {
+				break
+			}
+			log.Printf("🗑️ Deleted empty directory %s", dir)
+
+			if relative == "." {
+				break
+			}
+		}
+	}
+
+	return deleted, nil
+}
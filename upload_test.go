@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRemotePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		windows  bool
+		expected string
+	}{
+		{`D:\a\dist\app.zip`, true, "/a/dist/app.zip"},
+		{`c:\build`, true, "/build"},
+		{`C:foo\bar`, true, "foo/bar"},
+		{`D:`, true, "."},
+		{`\\server\share`, true, "/"},
+		{`\\server\share\`, true, "/"},
+		{`\\server\share\dir\file.txt`, true, "/dir/file.txt"},
+		{`//server/share/dir`, true, "/dir"},
+		{`C:\a/b\c`, true, "/a/b/c"},
+		{`dist\app.zip`, true, "dist/app.zip"},
+		{`./dist/app.zip`, true, "./dist/app.zip"},
+		{`C:\a\b`, false, `C:\a\b`},
+		{`\\server\share\dir`, false, `\\server\share\dir`},
+		{"/home/runner/dist", false, "/home/runner/dist"},
+	}
+
+	for _, test := range tests {
+		if actual := remotePath(test.name, test.windows); actual != test.expected {
+			t.Errorf("remotePath(%q, %v) = %q, expected %q", test.name, test.windows, actual, test.expected)
+		}
+	}
+}
+
+func TestLayoutRelativeWindowsSources(t *testing.T) {
+	tests := []struct {
+		source   string
+		layout   layout
+		expected string
+	}{
+		{`C:\build\bin\app.exe`, layout{Root: "/build"}, "bin/app.exe"},
+		{`C:\build/bin\app.exe`, layout{Root: "/build/bin"}, "app.exe"},
+		{`D:\a\dist\app.zip`, layout{Strip: 1}, "dist/app.zip"},
+		{`\\server\share\out\x\y.txt`, layout{Strip: 2}, "y.txt"},
+		{`dist\web\index.html`, layout{Root: "dist"}, "web/index.html"},
+	}
+
+	for _, test := range tests {
+		relative, ok := test.layout.relative(remotePath(test.source, true))
+		if !ok || relative != test.expected {
+			t.Errorf("relative path of %q is %q, %v, expected %q", test.source, relative, ok, test.expected)
+		}
+		if target := path.Join("/srv/app", relative); strings.Contains(target, `\`) {
+			t.Errorf("remote target %q of %q is not a POSIX path", target, test.source)
+		}
+	}
+}
+
+func TestPlanUploadLocalAndRemotePaths(t *testing.T) {
+	client := startTestServer(t)
+	unsetEnv(t, "FLATTEN", "EXCLUDE", "INCLUDE_HIDDEN", "STRIP_COMPONENTS", "INCLUDE_SOURCE_DIR")
+	os.Setenv("FLATTEN", "false")
+
+	dir := t.TempDir()
+	sources := []string{filepath.Join(dir, "build", "bin", "app.exe"), filepath.Join(dir, "build", "README.txt")}
+	for _, source := range sources {
+		if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(source, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transfers, err := newPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PlanUpload(transfers, sourceGroup{Sources: sources, Target: "/srv/app/"}, remoteSide{client}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{sources[0]: "/srv/app/bin/app.exe", sources[1]: "/srv/app/README.txt"}
+	if len(transfers.Transfers) != len(expected) {
+		t.Fatalf("planned %d transfers, expected %d", len(transfers.Transfers), len(expected))
+	}
+	for _, transfer := range transfers.Transfers {
+		if transfer.Target != expected[transfer.Source] {
+			t.Errorf("target of %s is %q, expected %q", transfer.Source, transfer.Target, expected[transfer.Source])
+		}
+		// The local source is kept as a path of the local system, so that it can be opened.
+		file, err := os.Open(transfer.Source)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		file.Close()
+	}
+}
+
+func TestPlanUploadHiddenAndExclude(t *testing.T) {
+	client := startTestServer(t)
+	unsetEnv(t, "FLATTEN", "EXCLUDE", "INCLUDE_HIDDEN", "STRIP_COMPONENTS", "INCLUDE_SOURCE_DIR")
+
+	dir := t.TempDir()
+	for _, name := range []string{"app.js", "lib/util.js", ".env", ".htaccess", ".cache/foo", "lib/.cache/bar"} {
+		name = filepath.Join(dir, "src", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := filepath.Join(dir, "src")
+
+	tests := []struct {
+		name     string
+		source   string
+		hidden   string
+		exclude  string
+		expected []string
+	}{
+		{"hidden by default", src, "", "", []string{".cache/foo", ".env", ".htaccess", "app.js", "lib/.cache/bar", "lib/util.js"}},
+		{"without hidden", src, "false", "", []string{"app.js", "lib/util.js"}},
+		{"exclude at any depth", src, "true", ".cache/**\n*.js", []string{".env", ".htaccess"}},
+		{"anchored exclude", src, "true", "/.cache/**", []string{".env", ".htaccess", "app.js", "lib/.cache/bar", "lib/util.js"}},
+		{"exclude without hidden", src, "false", "lib/**", []string{"app.js"}},
+		{"exclude hidden name", src, "true", "**/.cache", []string{".env", ".htaccess", "app.js", "lib/util.js"}},
+		// Matched directories are copied by their contents.
+		{"glob without hidden", filepath.Join(src, "*"), "false", "", []string{"app.js", "util.js"}},
+		{"glob naming hidden files", filepath.Join(src, ".*"), "false", ".env", []string{".htaccess", "foo"}},
+	}
+
+	for _, test := range tests {
+		os.Setenv("INCLUDE_HIDDEN", test.hidden)
+		os.Setenv("EXCLUDE", test.exclude)
+
+		transfers, err := newPlan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := PlanUpload(transfers, sourceGroup{Sources: []string{test.source}, Target: "/srv/app/"}, remoteSide{client}); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		var planned []string
+		for _, transfer := range transfers.Transfers {
+			planned = append(planned, strings.TrimPrefix(transfer.Target, "/srv/app/"))
+		}
+		sort.Strings(planned)
+		if !reflect.DeepEqual(planned, test.expected) {
+			t.Errorf("%s: planned %q, expected %q", test.name, planned, test.expected)
+		}
+	}
+}